@@ -1,18 +1,15 @@
 package client
 
 import (
-	"bytes"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net"
-	"net/http"
 	"os"
 	"os/exec"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/mdns"
@@ -30,20 +27,46 @@ var log = logger.GetLogger("Client")
 var orphanTimeout = config.Duration(time.Second*30, "client.orphanTimeout")
 var defaultTimeout = time.Second * 5
 
+// How long to wait for HomeCloud before exporting the node device anyway.
+var nodeDeviceReadyTimeout = config.Duration(time.Second*30, "client", "nodeDevice", "readyTimeout")
+
 const (
-	clientHelperPath = "/opt/ninjablocks/bin/client-helper.sh"
+	clientHelperPath    = "/opt/ninjablocks/bin/client-helper.sh"
+	sitePreferencesFile = "/data/etc/opt/ninja/site-preferences.json"
 )
 
+// connectBus is used by the mesh bridge to connect to the local and master mqtt brokers.
+var connectBus = bus.ConnectWithOptions
+
 type client struct {
-	conn                 *ninja.Connection
-	master               bool
-	bridged              bool
-	led                  *ninja.ServiceClient
-	foundMaster          chan bool
-	localBus             bus.Bus
-	masterBus            bus.Bus
-	masterReceiveTimeout *time.Timer
-	nodeDevice           *NodeDevice
+	conn        *ninja.Connection
+	state       *stateMachine
+	led         *ninja.ServiceClient
+	foundMaster chan bool
+	cloud       CloudAPI
+	services    ServiceManager
+	readiness   *readiness
+	nodeDevice  *NodeDevice
+	peers       *peerRegistry
+	browser     *mdnsBrowser
+
+	// Requests to (re-)export the node device.
+	nodeDeviceExports chan struct{}
+
+	// switching serialises changes of master.
+	switching sync.Mutex
+
+	// mu guards everything below. It must not be held while changing state.
+	mu                sync.Mutex
+	bridge            *meshBridge
+	lastMasterMessage time.Time
+	echoes            meshEchoes
+	devices           *deviceOwnership
+
+	// Only set while we are the master.
+	pairingListener     net.Listener
+	joins               *pendingJoins
+	masterSubscriptions []*bus.Subscription
 }
 
 type bridgeStatus struct {
@@ -51,7 +74,18 @@ type bridgeStatus struct {
 	Configured bool `json:"configured"`
 }
 
+// Start starts the client, talking to the cloud configured in the "cloud" config section.
 func Start() {
+	cloud, err := NewHTTPCloud(config.String("", "cloud", "baseUrl"), nil)
+	if err != nil {
+		log.Fatalf("Failed to create cloud client: %s", err)
+	}
+
+	StartWithCloud(cloud)
+}
+
+// StartWithCloud starts the client, using the provided cloud for pairing and mesh information.
+func StartWithCloud(cloud CloudAPI) {
 
 	log.Infof("Starting client on Node: %s", config.Serial())
 
@@ -60,16 +94,67 @@ func Start() {
 		log.Fatalf("Failed to connect to sphere: %s", err)
 	}
 
+	if restoreFiles(credsFile, meshFile, sitePreferencesFile) {
+		log.Infof("Restored config files from backup, reloading config.")
+		config.MustRefresh()
+	}
+
+	// Migrates the credentials to the current format if needed, and writes the decrypted view
+	// (which is on tmpfs, so gone after a reboot) before anything reads the token from the config.
+	if _, err := loadCreds(); err == nil {
+		config.MustRefresh()
+	} else if !os.IsNotExist(err) {
+		log.Warningf("Failed to load credentials: %s", err)
+	}
+
+	services, err := NewServiceManager()
+	if err != nil {
+		log.Warningf("Failed to create service manager: %s", err)
+		log.Warningf("!!! NOT CONTROLLING ANY SERVICES. HomeCloud and the director won't be started or stopped as this node's role changes. !!!")
+		services = &noopServiceManager{}
+	}
+
+	initialState := stateUnpaired
+	if isPaired() || config.NoCloud() {
+		initialState = statePaired
+	}
+
 	client := &client{
 		conn:        conn,
+		state:       newStateMachine(initialState),
 		led:         conn.GetServiceClient("$home/led-controller"),
 		foundMaster: make(chan bool),
+		cloud:       cloud,
+		services:    services,
+		readiness:   newReadiness(conn, readinessProbes),
+
+		nodeDeviceExports: make(chan struct{}, 1),
 	}
 
-	if !config.IsPaired() {
-		err = UpdateSphereAvahiService(false, false)
-		if err != nil {
-			log.Fatalf("Failed to update avahi service: %s", err)
+	client.nodeDevice = newNodeDevice(client)
+
+	client.peers = newPeerRegistry(peerExpiry, client.onPeerJoin, client.onPeerLeave)
+	client.peers.start()
+
+	if mdnsBrowseEnabled {
+		client.browser = newMdnsBrowser(peerService, client.onPeerEntry, client.onPeerRemoved)
+	}
+	go client.runNodeDeviceExports()
+
+	// HomeCloud has (re)started. It rediscovers the node device itself, but needs its health again.
+	client.readiness.onChange(func(service string, ready bool) {
+		if service == siteModelService && ready {
+			client.requestNodeDeviceExport()
+		}
+	})
+
+	client.state.onTransition(client.onStateChange)
+
+	client.startStatusServer()
+
+	if !isPaired() {
+		if err := UpdateSphereAvahiService(false, false); err != nil {
+			log.Warningf("Failed to update avahi service: %s", err)
 		}
 	}
 
@@ -81,11 +166,6 @@ func Start() {
 
 	log.Infof("Client started.")
 
-	err = UpdateSphereAvahiService(true, client.master)
-	if err != nil {
-		log.Fatalf("Failed to update avahi service: %s", err)
-	}
-
 	if runtime.GOOS == "linux" {
 		go func() {
 			err := client.ensureTimezoneIsSet()
@@ -95,15 +175,18 @@ func Start() {
 		}()
 	}
 
-	listenToSiteUpdates(conn)
+	go client.listenToSiteUpdates()
 }
 
 func (c *client) start() {
 
 	if !config.NoCloud() {
-		if !config.IsPaired() {
+		if !isPaired() {
 			log.Infof("Client is unpaired. Attempting to pair.")
+			c.setState(statePairing)
+
 			if err := c.pair(); err != nil {
+				c.setState(stateUnpaired)
 				log.Fatalf("An error occurred while pairing. Restarting. error: %s", err)
 			}
 
@@ -111,26 +194,40 @@ func (c *client) start() {
 			// We reload the config so the creds can be picked up
 			config.MustRefresh()
 
-			if !config.IsPaired() {
+			if !isPaired() {
 				log.Fatalf("Pairing appeared successful, but I did not get the credentials. Restarting.")
 			}
 
+			c.setState(statePaired)
 		}
 
 		log.Infof("Client is paired. User: %s", config.MustString("userId"))
 
-		mesh, err := refreshMeshInfo()
+		if locallyPaired() {
+			log.Infof("Client was paired locally, so using the mesh info from the master.")
+		} else {
+			var mesh *meshInfo
+			err := c.retry(meshRetry, func() error {
+				var err error
+				mesh, err = refreshMeshInfo(c.cloud)
+				if err == errorUnauthorised {
+					return permanent(err)
+				}
+				return err
+			})
 
-		if err == errorUnauthorised {
-			log.Warningf("UNAUTHORISED! Unpairing.")
-			c.unpair()
-			return
-		}
+			if err == errorUnauthorised {
+				log.Warningf("UNAUTHORISED! Unpairing.")
+				c.unpair()
+				c.setState(stateUnpaired)
+				return
+			}
 
-		if err != nil {
-			log.Warningf("Failed to refresh mesh info: %s", err)
-		} else {
-			log.Debugf("Got mesh info: %+v", mesh)
+			if err != nil {
+				log.Warningf("Failed to refresh mesh info: %s", err)
+			} else {
+				log.Debugf("Got mesh info: %+v", mesh)
+			}
 		}
 
 		config.MustRefresh()
@@ -141,27 +238,110 @@ func (c *client) start() {
 			os.Exit(0)
 		}
 
+	} else if !config.HasString("masterNodeId") {
+		if err := c.bootstrapOffline(); err != nil {
+			log.Fatalf("Failed to bootstrap offline mesh. Restarting. error: %s", err)
+		}
+
+		config.MustRefresh()
 	}
 
-	if config.MustString("masterNodeId") == config.Serial() {
-		log.Infof("I am the master, starting HomeCloud.")
+	c.readiness.start()
 
-		cmd := exec.Command("service", "sphere-homecloud", "start")
-		cmd.Output()
-		go c.exportNodeDevice()
+	if slaveDriversEnabled {
+		c.startDeviceOwnership()
+	}
 
-		c.master = true
+	if config.MustString("masterNodeId") == config.Serial() {
+		c.setState(stateMaster)
 	} else {
-		log.Infof("I am a slave. The master is %s", config.MustString("masterNodeId"))
+		c.setState(stateSlaveSearching)
+	}
 
-		// TODO: Remove this when we are running drivers on slaves
-		cmd := exec.Command("stop", "sphere-director")
-		cmd.Output()
+	go c.watchMaster()
+	go c.runElections()
+	go c.publishNodeHealth()
 
-		c.masterReceiveTimeout = time.AfterFunc(orphanTimeout, func() {
-			c.setOrphaned()
+	c.startPeerDiscovery()
+}
+
+// requestNodeDeviceExport asks for the node device to be exported, if it hasn't been, and its
+// health to be sent again, e.g. after the master has changed.
+func (c *client) requestNodeDeviceExport() {
+	select {
+	case c.nodeDeviceExports <- struct{}{}:
+	default:
+	}
+}
+
+// runNodeDeviceExports exports the node device each time it is requested, one export at a time.
+func (c *client) runNodeDeviceExports() {
+	for range c.nodeDeviceExports {
+		c.exportNodeDevice()
+	}
+}
+
+// exportNodeDevice exports the node device and its channels, once per connection. Every node
+// exports one, whether or not HomeCloud is reachable, so it is there as soon as we are bridged to
+// the master. Exporting again would subscribe to its methods again, so later requests only send
+// its health.
+func (c *client) exportNodeDevice() {
+
+	nodeDevice := c.nodeDevice
+
+	if nodeDevice.exportedTo(c.conn) {
+		c.sendNodeHealth(nodeDevice)
+		return
+	}
+
+	if err := c.readiness.wait(nodeDeviceReadyTimeout, siteModelService); err != nil {
+		log.Infof("Exporting the node device anyway: %s", err)
+	}
+
+	c.retry(exportRetry, func() error {
+		err := c.conn.ExportDevice(nodeDevice)
+		if err != nil {
+			return fmt.Errorf("Failed to export node device: %s", err)
+		}
+		return nil
+	})
+
+	for _, channel := range nodeDevice.channels {
+		channel := channel
+		c.retry(exportRetry, func() error {
+			err := c.conn.ExportChannel(nodeDevice, channel, channel.id)
+			if err != nil {
+				return fmt.Errorf("Failed to export node device channel %s: %s", channel.id, err)
+			}
+			return nil
 		})
+	}
+
+	nodeDevice.setExported(c.conn)
+	c.sendNodeHealth(nodeDevice)
+}
+
+// retry runs op using the given policy, publishing the retry state on $node/<serial>/client/retry.
+func (c *client) retry(policy *retryPolicy, op func() error) error {
+	return policy.run(op, func(state retryState) {
+		c.conn.PublishRaw(fmt.Sprintf("$node/%s/client/retry", config.Serial()), state)
+	})
+}
 
+const peerService = "_ninja-homecloud-mqtt._tcp"
+
+// startPeerDiscovery starts looking for other nodes, by browsing mDNS if we can, or with a lookup
+// every 30 seconds if not.
+func (c *client) startPeerDiscovery() {
+
+	interval := time.Second * 30
+
+	if c.browser != nil {
+		if err := c.browser.start(); err != nil {
+			log.Warningf("Failed to start mDNS browser, falling back to lookups: %s", err)
+		} else {
+			interval = mdnsQueryInterval
+		}
 	}
 
 	go func() {
@@ -170,288 +350,390 @@ func (c *client) start() {
 
 		for {
 			c.findPeers()
-			time.Sleep(time.Second * 30)
+			time.Sleep(interval)
 		}
 	}()
 }
 
-func (c *client) exportNodeDevice() {
+// findPeers handles every node we know about again, and asks for any we don't.
+func (c *client) findPeers() {
 
-	if c.nodeDevice != nil {
+	if c.browser != nil && c.browser.running() {
+		for _, entry := range c.browser.entries() {
+			c.onPeerEntry(entry)
+		}
+		c.browser.query()
 		return
 	}
 
-	c.nodeDevice = &NodeDevice{info: ninja.LoadModuleInfo("./package.json")}
-
-	// TODO: Make some generic way to see if homecloud is running.
-	// XXX: Fix this. It's ugly.
-	for {
-		siteModel := c.conn.GetServiceClient("$home/services/SiteModel")
-		err := siteModel.Call("fetch", config.MustString("siteId"), nil, time.Second*5)
-
-		if err == nil {
-			break
+	// Make a channel for results and start listening
+	entriesCh := make(chan *mdns.ServiceEntry, 4)
+	go func() {
+		for entry := range entriesCh {
+			c.onPeerEntry(entry)
 		}
+	}()
 
-		log.Infof("Failed to fetch siteid from sitemodel: %s", err)
-		time.Sleep(time.Second * 5)
-	}
+	// Start the lookup
+	mdns.Lookup(peerService, entriesCh)
+	close(entriesCh)
+}
 
-	for {
-		err := c.conn.ExportDevice(c.nodeDevice)
-		if err == nil {
-			break
-		}
+// onPeerRemoved is called when a node says goodbye, or its mDNS records expire.
+func (c *client) onPeerRemoved(entry *mdns.ServiceEntry) {
+	id, ok := parseMdnsInfo(entry.Info)["ninja.sphere.node_id"]
+	if !ok || id == config.Serial() {
+		return
+	}
 
-		log.Warningf("Failed to export node device. Retrying in 5 sec: %s", err)
-		time.Sleep(time.Second * 5)
+	if id == config.String("", "masterNodeId") {
+		log.Infof("The master (%s) has gone from the network", id)
 	}
 
+	c.peers.remove(id)
 }
 
-func (c *client) findPeers() {
+// onPeerEntry handles a node found on the network.
+func (c *client) onPeerEntry(entry *mdns.ServiceEntry) {
 
-	query := "_ninja-homecloud-mqtt._tcp"
+	if !strings.Contains(entry.Name, peerService) {
+		return
+	}
+	nodeInfo := parseMdnsInfo(entry.Info)
 
-	// Make a channel for results and start listening
-	entriesCh := make(chan *mdns.ServiceEntry, 4)
-	go func() {
-		for entry := range entriesCh {
+	id, ok := nodeInfo["ninja.sphere.node_id"]
 
-			if !strings.Contains(entry.Name, query) {
-				continue
-			}
-			nodeInfo := parseMdnsInfo(entry.Info)
+	if !ok {
+		log.Warningf("Found a node, but couldn't get it's node id. %v", entry)
+		return
+	}
 
-			id, ok := nodeInfo["ninja.sphere.node_id"]
+	if id == config.Serial() {
+		// It's me.
+		return
+	}
 
-			if !ok {
-				log.Warningf("Found a node, but couldn't get it's node id. %v", entry)
-				continue
-			}
+	user, ok := nodeInfo["ninja.sphere.user_id"]
+	if !ok {
+		log.Warningf("Found a node, but couldn't get it's user id. %v", entry)
+		return
+	}
 
-			if id == config.Serial() {
-				// It's me.
-				continue
-			}
+	site, ok := nodeInfo["ninja.sphere.site_id"]
 
-			user, ok := nodeInfo["ninja.sphere.user_id"]
-			if !ok {
-				log.Warningf("Found a node, but couldn't get it's user id. %v", entry)
-				continue
-			}
+	ours := user == config.MustString("userId") && site == config.MustString("siteId")
 
-			site, ok := nodeInfo["ninja.sphere.site_id"]
-			siteUpdated, ok := nodeInfo["ninja.sphere.site_updated"]
-			masterNodeID, ok := nodeInfo["ninja.sphere.master_node_id"]
+	if (ours || id == config.MustString("masterNodeId")) && !c.trustMdnsInfo(nodeInfo) {
+		log.Warningf("Ignoring node %s (%s) claiming to be in our site, as its mDNS records aren't signed with our network key", id, entry.Addr)
+		return
+	}
 
-			if user == config.MustString("userId") {
+	siteUpdated, ok := nodeInfo["ninja.sphere.site_updated"]
+	masterNodeID, ok := nodeInfo["ninja.sphere.master_node_id"]
 
-				if site == config.MustString("siteId") {
-					log.Infof("Found a sibling node (%s) - %s", id, entry.Addr)
+	peer := peerInfo{
+		ID:           id,
+		UserID:       user,
+		SiteID:       site,
+		Master:       nodeInfo["ninja.sphere.master"] == "true",
+		MasterNodeID: masterNodeID,
+		SiteUpdated:  siteUpdated,
+		Address:      entry.Addr.String(),
+		Port:         entry.Port,
+		LastSeen:     time.Now(),
+	}
+	c.peers.update(peer)
+	c.checkHandback(&peer)
 
-					siteUpdatedInt, err := strconv.ParseInt(siteUpdated, 10, 64)
+	if user == config.MustString("userId") {
 
-					if err != nil {
-						log.Warningf("Failed to read the site_updated field (%s) on node %s - %s", siteUpdated, id, entry.Addr)
-					} else {
-						if int(siteUpdatedInt) > config.MustInt("siteUpdated") {
-
-							log.Infof("Found node (%s - %s) with a newer site update time (%s).", id, entry.Addr, siteUpdated)
-
-							info := &meshInfo{
-								MasterNodeID: masterNodeID,
-								SiteID:       config.MustString("siteId"),
-								SiteUpdated:  int(siteUpdatedInt),
-							}
-
-							err := saveMeshInfo(info)
-							if err != nil {
-								log.Warningf("Failed to save updated mesh info from node: %s - %+v", err, info)
-							}
-
-							if masterNodeID == config.MustString("masterNodeId") {
-								log.Infof("Updated master id is the same (%s). Moving on with our lives.", masterNodeID)
-							} else {
-								log.Infof("Master id has changed (was %s now %s). Rebooting", config.MustString("masterNodeId"), masterNodeID)
-
-								reboot()
-								return
-							}
-						}
-					}
+		if site == config.MustString("siteId") {
+			log.Infof("Found a sibling node (%s) - %s", id, entry.Addr)
 
-				} else {
-					log.Warningf("Found a node owned by the same user (%s) but from a different site (%s) - ID:%s - %s", user, site, id, entry.Addr)
-				}
+			siteUpdatedInt, err := strconv.ParseInt(siteUpdated, 10, 64)
 
+			if err != nil {
+				log.Warningf("Failed to read the site_updated field (%s) on node %s - %s", siteUpdated, id, entry.Addr)
 			} else {
-				log.Infof("Found a node owned by another user (%s) (%s) - %s", user, id, entry.Addr)
-			}
+				if int(siteUpdatedInt) > config.MustInt("siteUpdated") {
 
-			if id == config.MustString("masterNodeId") {
-				log.Infof("Found the master node (%s) - %s", id, entry.Addr)
+					log.Infof("Found node (%s - %s) with a newer site update time (%s).", id, entry.Addr, siteUpdated)
 
-				select {
-				case c.foundMaster <- true:
-				default:
-				}
+					info := &meshInfo{
+						MasterNodeID: masterNodeID,
+						SiteID:       config.MustString("siteId"),
+						SiteUpdated:  int(siteUpdatedInt),
+					}
+
+					err := saveMeshInfo(info)
+					if err != nil {
+						log.Warningf("Failed to save updated mesh info from node: %s - %+v", err, info)
+					}
+
+					if masterNodeID == config.MustString("masterNodeId") {
+						log.Infof("Updated master id is the same (%s). Moving on with our lives.", masterNodeID)
+					} else {
+						log.Infof("Master id has changed (was %s now %s).", config.MustString("masterNodeId"), masterNodeID)
 
-				if !c.bridged {
-					c.bridgeToMaster(entry.Addr, entry.Port)
-					c.bridged = true
-					c.exportNodeDevice()
+						c.switchMaster(masterNodeID)
+						return
+					}
 				}
 			}
 
+		} else {
+			log.Warningf("Found a node owned by the same user (%s) but from a different site (%s) - ID:%s - %s", user, site, id, entry.Addr)
 		}
-	}()
 
-	// Start the lookup
-	mdns.Lookup(query, entriesCh)
-	close(entriesCh)
-}
+	} else {
+		log.Infof("Found a node owned by another user (%s) (%s) - %s", user, id, entry.Addr)
+	}
 
-func (c *client) setOrphaned() {
-	log.Infof("Client has been orphaned")
+	if id == config.MustString("masterNodeId") {
+		log.Infof("Found the master node (%s) - %s", id, entry.Addr)
 
-	c.bridged = false
-	if c.localBus != nil {
-		c.localBus.Destroy()
-		c.masterBus.Destroy()
-	}
+		select {
+		case c.foundMaster <- true:
+		default:
+		}
 
-	err := c.led.Call("disableControl", nil, nil, time.Second*5)
-	if err != nil {
-		log.Warningf("Failed to disable control on LED controller: %s", err)
+		if c.state.is(stateSlaveSearching, stateOrphaned) {
+			c.bridgeToMaster(entry.Addr, entry.Port)
+		}
 	}
+}
 
-	err = c.led.Call("displayIcon", ledmodel.IconRequest{
-		Icon: "orphaned.gif",
-	}, nil, time.Second)
+// trustMdnsInfo checks the mesh signature on a sibling's TXT records. Once we have the network key
+// they must be signed with it, as anything on the LAN can advertise our site. Without it there is
+// nothing to check them with, so they are trusted as before.
+func (c *client) trustMdnsInfo(info map[string]string) bool {
+	key, err := networkKey()
 	if err != nil {
-		log.Infof("Failed to display orphaned image on LED controller: %s", err)
+		return true
 	}
-}
 
-func (c *client) setUnorphaned() {
-	log.Infof("Client has been unorphaned")
+	return verifyMeshTXT(key, info)
+}
 
-	err := c.led.Call("enableControl", nil, nil, time.Second*5)
-	if err != nil {
-		log.Warningf("Failed to disable control on LED controller: %s", err)
+// setState moves the client to a new state, logging if that isn't allowed from the current one.
+func (c *client) setState(state clientState) {
+	if err := c.state.transition(state); err != nil {
+		log.Warningf("%s", err)
 	}
 }
 
-func (c *client) bridgeToMaster(host net.IP, port int) {
+// onStateChange is where everything that happens as the client moves between states hangs off.
+func (c *client) onStateChange(from, to clientState) {
 
-	log.Debugf("Bridging to the master: %s:%d", host, port)
+	c.conn.PublishRaw(fmt.Sprintf("$node/%s/client/state", config.Serial()), map[string]string{
+		"state":    string(to),
+		"previous": string(from),
+	})
 
-	mqttURL := fmt.Sprintf("%s:%d", host, port)
+	switch to {
+	case statePaired:
+		if from != statePairing {
+			c.stepDown(from)
+		}
 
-	clientID := "slave-" + config.Serial()
+	case stateUnpaired:
+		if from != statePairing {
+			if err := UpdateSphereAvahiService(false, false); err != nil {
+				log.Warningf("Failed to update avahi service: %s", err)
+			}
+		}
 
-	log.Infof("Connecting to master %s using cid:%s", mqttURL, clientID)
+	case stateMaster:
+		log.Infof("I am the master, starting HomeCloud.")
 
-	c.masterBus = bus.MustConnect(mqttURL, clientID)
-	c.localBus = bus.MustConnect(fmt.Sprintf("%s:%d", config.MustString("mqtt.host"), config.MustInt("mqtt.port")), "meshing")
+		c.startService(homeCloudService)
 
-	log.Infof("Connected to master? %t", c.masterBus.Connected())
+		// In case we were a slave before
+		c.startService(directorService)
 
-	if c.masterBus.Connected() {
-		c.setUnorphaned()
-	} else {
-		c.setOrphaned()
-	}
+		c.requestNodeDeviceExport()
+		c.answerBridgeChallenges()
+		c.startPairingServer()
 
-	c.masterBus.OnDisconnect(func() {
-		log.Infof("Disconnected from master")
-		go func() {
-			time.Sleep(time.Second * 5)
-			if !c.masterBus.Connected() {
-				log.Infof("Still disconnected from master, setting orphaned.")
-				c.setOrphaned()
+		if err := UpdateSphereAvahiService(true, true); err != nil {
+			log.Warningf("Failed to update avahi service: %s", err)
+		}
+
+	case stateSlaveSearching:
+		if from == statePaired {
+			log.Infof("I am a slave. The master is %s", config.MustString("masterNodeId"))
+
+			if slaveDriversEnabled {
+				c.startService(directorService)
+			} else {
+				c.stopService(directorService)
 			}
-		}()
-	})
 
-	c.masterBus.OnConnect(func() {
-		log.Infof("Connected to master")
-		go func() {
-			time.Sleep(time.Second * 2)
-			if !c.masterBus.Connected() {
-				log.Infof("Still connected to master, setting unorphaned")
-				c.setUnorphaned()
+			c.touchMaster()
+			c.requestNodeDeviceExport()
+
+			if err := UpdateSphereAvahiService(true, false); err != nil {
+				log.Warningf("Failed to update avahi service: %s", err)
 			}
-		}()
-	})
+		} else {
+			c.unbridge()
+		}
 
-	bridgeTopics := []string{"$discover", "$site/#", "$home/#" /*deprecated*/, "$node/#", "$thing/#", "$device/#"}
+	case stateSlaveBridged:
+		c.touchMaster()
+		if from == stateOrphaned {
+			c.enableLEDControl()
+		}
+		c.requestNodeDeviceExport()
 
-	c.bridgeMqtt(c.masterBus, c.localBus, true, bridgeTopics)
-	c.bridgeMqtt(c.localBus, c.masterBus, false, bridgeTopics)
-}
+	case stateOrphaned:
+		c.showOrphaned()
+	}
 
-type meshMessage struct {
-	Source *string `json:"$mesh-source"`
+	c.sendNodeStatus()
 }
 
-// bridgeMqtt connects one mqtt broker to another. Shouldn't probably be doing this. But whatever.
-func (c *client) bridgeMqtt(from, to bus.Bus, masterToSlave bool, topics []string) {
+// unbridge disconnects from the master, so the next search for peers bridges to it again.
+func (c *client) unbridge() {
+	c.mu.Lock()
+	bridge := c.bridge
+	c.bridge = nil
+	c.mu.Unlock()
 
-	onMessage := func(topic string, payload []byte) {
+	if bridge != nil {
+		bridge.close()
+	}
+}
 
-		if masterToSlave {
-			// This is a message from master, clear the timeout
-			c.masterReceiveTimeout.Reset(orphanTimeout)
+// touchMaster records that we have just heard from the master.
+func (c *client) touchMaster() {
+	c.mu.Lock()
+	c.lastMasterMessage = time.Now()
+	c.mu.Unlock()
+}
+
+// watchMaster orphans the client if it hasn't heard from the master within the orphan timeout.
+func (c *client) watchMaster() {
+	for range time.Tick(time.Second) {
+		if !c.state.is(stateSlaveSearching, stateSlaveBridged) {
+			continue
 		}
 
-		if payload[0] != '{' {
-			log.Warningf("Invalid payload (should be a json-rpc object): %s", payload)
-			return
+		c.mu.Lock()
+		silence := time.Since(c.lastMasterMessage)
+		c.mu.Unlock()
+
+		if silence > orphanTimeout {
+			log.Infof("Haven't heard from the master in %s", silence)
+			c.setOrphaned()
 		}
+	}
+}
 
-		var msg meshMessage
-		json.Unmarshal(payload, &msg)
+func (c *client) bridgeHealth() *meshBridgeHealth {
+	c.mu.Lock()
+	bridge := c.bridge
+	c.mu.Unlock()
 
-		interesting := false
+	if bridge == nil {
+		return nil
+	}
 
-		if masterToSlave {
-			// Interesting if it's from the master or one of the other slaves
-			interesting = msg.Source == nil || (*msg.Source != config.Serial())
-		} else {
-			// Interesting if it's from me
-			interesting = msg.Source == nil
-		}
+	health := bridge.getHealth()
+	return &health
+}
 
-		log.Infof("Mesh master2slave:%t topic:%s interesting:%t", masterToSlave, topic, interesting)
+// rebridge drops the connection to the master and searches for it again.
+func (c *client) rebridge() {
+	if !c.state.is(stateSlaveBridged, stateOrphaned) {
+		return
+	}
+	c.setState(stateSlaveSearching)
+	c.state.wait()
+	c.findPeers()
+}
 
-		if interesting {
+func (c *client) setOrphaned() {
+	log.Infof("Client has been orphaned")
+	c.setState(stateOrphaned)
+}
 
-			if msg.Source == nil {
-				if masterToSlave {
-					payload = addMeshSource(config.MustString("masterNodeId"), payload)
-				} else {
-					payload = addMeshSource(config.Serial(), payload)
-				}
-			}
+func (c *client) setUnorphaned() {
+	log.Infof("Client has been unorphaned")
+	c.setState(stateSlaveBridged)
+}
 
-			to.Publish(topic, payload)
-		}
+func (c *client) showOrphaned() {
+	err := c.led.Call("disableControl", nil, nil, time.Second*5)
+	if err != nil {
+		log.Warningf("Failed to disable control on LED controller: %s", err)
+	}
+
+	err = c.led.Call("displayIcon", ledmodel.IconRequest{
+		Icon: "orphaned.gif",
+	}, nil, time.Second)
+	if err != nil {
+		log.Infof("Failed to display orphaned image on LED controller: %s", err)
+	}
+}
 
+func (c *client) enableLEDControl() {
+	err := c.led.Call("enableControl", nil, nil, time.Second*5)
+	if err != nil {
+		log.Warningf("Failed to enable control on LED controller: %s", err)
 	}
+}
 
-	for _, topic := range topics {
-		_, err := from.Subscribe(topic, onMessage)
-		if err != nil {
-			log.Fatalf("Failed to subscribe to topic %s when bridging to master: %s", topic, err)
+// bridgeToMaster starts bridging to the master's mqtt broker, or just updates its address if we
+// already are.
+func (c *client) bridgeToMaster(host net.IP, port int) {
+
+	log.Debugf("Bridging to the master: %s:%d", host, port)
+
+	mqttURL := fmt.Sprintf("%s:%d", host, port)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.bridge != nil {
+		c.bridge.setMaster(mqttURL)
+		return
+	}
+
+	c.bridge = newMeshBridge(
+		mqttURL,
+		"slave-"+config.Serial(),
+		fmt.Sprintf("%s:%d", config.MustString("mqtt.host"), config.MustInt("mqtt.port")),
+		loadBridgeRules(),
+		c.filterBridgeMessage,
+		c.onBridgeHealth,
+		c.retry,
+	)
+	c.bridge.authenticate = c.authenticateMaster
+
+	if bridgeBrokerAuth {
+		if key, err := networkKey(); err != nil {
+			log.Warningf("Can't log in to the master broker: %s", err)
+		} else {
+			username, password := brokerCredentials(key, config.Serial())
+			c.bridge.masterLogin = &bus.ClientOptions{
+				Username: username,
+				Password: password,
+			}
 		}
 	}
 
+	c.bridge.start()
 }
 
-func addMeshSource(source string, payload []byte) []byte {
-	return bytes.Replace(payload, []byte("{"), []byte(`{"$mesh-source":"`+source+`", `), 1)
+func (c *client) onBridgeHealth(health meshBridgeHealth) {
+	c.conn.PublishRaw(fmt.Sprintf("$node/%s/client/bridge", config.Serial()), health)
+
+	if health.Connected {
+		c.setUnorphaned()
+	} else {
+		c.setOrphaned()
+	}
 }
 
 func (c *client) onBridgeStatus(status *bridgeStatus) bool {
@@ -460,19 +742,19 @@ func (c *client) onBridgeStatus(status *bridgeStatus) bool {
 	if status.Connected {
 		c.updatePairingLight("green", false)
 	} else {
-		if c.master {
+		if c.state.is(stateMaster) {
 			c.updatePairingLight("red", true)
 		} else {
 			c.updatePairingLight("blue", false)
 		}
 	}
 
-	if !status.Configured && c.master && !config.NoCloud() {
+	if !status.Configured && c.state.is(stateMaster) && !config.NoCloud() {
 		log.Infof("Configuring bridge")
 
 		c.conn.PublishRawSingleValue("$sphere/bridge/connect", map[string]string{
 			"url":   config.MustString("cloud", "url"),
-			"token": config.MustString("token"),
+			"token": credsToken(),
 		})
 	}
 
@@ -512,76 +794,106 @@ func (c *client) pair() error {
 
 	log.Debugf("Board type: %s", boardType)
 
-	client := &http.Client{
-		Timeout: time.Second * 60, // It's 20sec on the server so this *should* be ok
-	}
+	done := make(chan struct{})
+	defer close(done)
 
-	if config.Bool(false, "cloud", "allowSelfSigned") {
-		log.Warningf("Allowing self-signed certificate (should only be used to connect to development cloud)")
-		client.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
+	type result struct {
+		creds *Credentials
+		grant *joinGrant
+		err   error
 	}
 
-	var creds *credentials
+	results := make(chan result, 2)
+	pending := 1
 
-	for {
-		url := fmt.Sprintf(config.MustString("cloud", "activation"), config.Serial(), getLocalIP(), boardType)
+	go func() {
+		creds, err := c.activate(boardType, done)
+		results <- result{creds: creds, err: err}
+	}()
 
-		log.Debugf("Activating at URL: %s", url)
+	if localPairingAllowed() {
+		pending++
+		go func() {
+			grant, err := c.pairLocally(done)
+			results <- result{grant: grant, err: err}
+		}()
+	}
 
-		var err error
-		creds, err = activate(client, url)
+	var err error
+	for ; pending > 0; pending-- {
+		r := <-results
 
-		if err != nil {
-			log.Warningf("Activation error : %s", err)
-			log.Warningf("Sleeping for 3sec")
-			time.Sleep(time.Second * 3)
-		} else if creds != nil {
-			break
+		if r.err != nil {
+			log.Warningf("Pairing failed: %s", r.err)
+			err = r.err
+			continue
+		}
+
+		if r.grant != nil {
+			log.Infof("Joined master %s. User: %s", r.grant.MasterNodeID, r.grant.UserID)
+			return saveJoinGrant(r.grant)
 		}
-	}
 
-	log.Infof("Got credentials. User: %s", creds.UserID)
+		log.Infof("Got credentials. User: %s", r.creds.UserID)
+		return saveCreds(r.creds)
+	}
 
-	return saveCreds(creds)
+	return err
 }
 
-var credsFile = config.String("/data/etc/opt/ninja/credentials.json", "credentialFile")
+// activate claims this node through the cloud, until it succeeds or done is closed. Closing done
+// also cancels an activation request in flight.
+func (c *client) activate(boardType string, done <-chan struct{}) (*Credentials, error) {
 
-func saveCreds(creds *credentials) error {
+	var creds *Credentials
 
-	log.Infof("Saving credentials to %s", credsFile)
+	err := c.retry(activationRetry, func() error {
+		select {
+		case <-done:
+			return permanent(errPairingCancelled)
+		default:
+		}
 
-	credsJSON, err := json.Marshal(creds)
-	if err != nil {
-		return fmt.Errorf("Failed to marshal credentials: %s", err)
-	}
+		log.Debugf("Activating node %s", config.Serial())
 
-	// XXX: HACK: TODO: CHANGE ME BACK TO 600
-	err = ioutil.WriteFile(credsFile, credsJSON, 0644)
+		var err error
+		creds, err = c.cloud.Activate(config.Serial(), getLocalIP(), boardType, done)
 
-	if err != nil {
-		return fmt.Errorf("Failed to write credentials file: %s", err)
-	}
+		select {
+		case <-done:
+			return permanent(errPairingCancelled)
+		default:
+		}
 
-	cmd := exec.Command("sync")
-	out, err := cmd.Output()
+		if err == nil && creds == nil {
+			// The activation request timed out waiting for the user, so just ask again.
+			return errRetryNow
+		}
 
-	if err != nil {
-		return fmt.Errorf("Failed to call sync after saving credentials: %s - %s", err, out)
-	}
+		return err
+	})
 
-	return nil
+	return creds, err
 }
 
 func (c *client) unpair() {
 	log.Infof("Unpairing")
+
+	if err := c.cloud.Unpair(config.Serial()); err != nil && err != errorUnpairUnsupported {
+		log.Warningf("Failed to unpair from the cloud: %s", err)
+	}
+
+	if err := deleteCreds(); err != nil {
+		log.Warningf("%s", err)
+	}
+
 	c.conn.SendNotification(fmt.Sprintf("$node/%s/unpair", config.Serial()), nil)
 }
 
 func (c *client) ensureTimezoneIsSet() error {
 
+	c.readiness.wait(0, siteModelService)
+
 	siteModel := c.conn.GetServiceClient("$home/services/SiteModel")
 	var site model.Site
 
@@ -608,68 +920,6 @@ func (c *client) ensureTimezoneIsSet() error {
 
 }
 
-type nodeClaimResponse struct {
-	Type string `json:"type"`
-	Data struct {
-		UserID           string `json:"user_id"`
-		NodeID           string `json:"node_id"`
-		Token            string `json:"token"`
-		SphereNetworkKey string `json:"sphere_network_key"`
-	} `json:"data"`
-}
-
-type credentials struct {
-	UserID           string `json:"userId"`
-	Token            string `json:"token"`
-	SphereNetworkKey string `json:"sphereNetworkKey"`
-}
-
-func activate(client *http.Client, url string) (*credentials, error) {
-
-	log.Debugf("Requesting url: %s", url)
-
-	resp, err := client.Get(url)
-	if err != nil {
-		return nil, err
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	if resp.StatusCode == http.StatusRequestTimeout {
-		return nil, nil
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Failed to activate: %s - %s", resp.Status, body)
-	}
-
-	log.Debugf("Got response: %s", body)
-
-	var response nodeClaimResponse
-	err = json.Unmarshal(body, &response)
-
-	if err != nil {
-		log.Fatalf("Failed to unmarshal credentials from cloud: %s (%s)", body, err)
-	}
-
-	if response.Data.NodeID != config.Serial() {
-		log.Fatalf("Incorrect node id returned from pairing! Expected %s got %s", config.Serial(), response.Data.NodeID)
-	}
-
-	if response.Data.UserID == "" || response.Data.Token == "" || response.Data.SphereNetworkKey == "" {
-		log.Fatalf("Invalid credentials (missing value): %s", body)
-	}
-
-	return &credentials{
-		UserID:           response.Data.UserID,
-		Token:            response.Data.Token,
-		SphereNetworkKey: response.Data.SphereNetworkKey,
-	}, err
-}
-
 func parseMdnsInfo(field string) map[string]string {
 	vals := make(map[string]string)
 
@@ -682,10 +932,12 @@ func parseMdnsInfo(field string) map[string]string {
 	return vals
 }
 
-// update the site-preferences.json file with a copy read from the site model
-func listenToSiteUpdates(conn *ninja.Connection) {
+// update the site-preferences.json file with a copy read from the site model, once it is ready
+func (c *client) listenToSiteUpdates() {
+	c.readiness.wait(0, siteModelService)
+
 	configSiteId := config.MustString("siteId")
-	siteModel := conn.GetServiceClient("$home/services/SiteModel")
+	siteModel := c.conn.GetServiceClient("$home/services/SiteModel")
 	siteModel.OnEvent("updated", func(siteId *string, values map[string]string) bool {
 		if siteId != nil && configSiteId == *siteId {
 			err := updateSitePreferences(siteModel, *siteId)
@@ -719,29 +971,24 @@ func updateSitePreferences(siteModel *ninja.ServiceClient, siteId string) error
 		return err
 	} else {
 
-		prefFileName := "/data/etc/opt/ninja/site-preferences.json"
-
 		// we only replace site-preferences if they have changed in order
 		// to avoid unnecessary writes onto the flash card.
 		updateRequired := true
 
-		if s, err := os.Open(prefFileName); err == nil {
-			existing := make([]byte, 0)
-			if existing, err = ioutil.ReadAll(s); err == nil {
-				if len(existing) == len(update) {
-					updateRequired = false
-					for i, b := range existing {
-						if update[i] != b {
-							updateRequired = true
-							break
-						}
+		if existing, err := loadFile(sitePreferencesFile); err == nil {
+			if len(existing) == len(update) {
+				updateRequired = false
+				for i, b := range existing {
+					if update[i] != b {
+						updateRequired = true
+						break
 					}
 				}
 			}
 		}
 
 		if updateRequired {
-			if err := ioutil.WriteFile(prefFileName, update, 0644); err != nil {
+			if err := saveFile(sitePreferencesFile, update, 0644); err != nil {
 				return err
 			}
 			cmd := exec.Command(clientHelperPath, "apply-site-preferences")
@@ -1,14 +1,49 @@
 package client
 
 import (
+	"sync"
+
 	"github.com/ninjasphere/go-ninja/api"
 	"github.com/ninjasphere/go-ninja/config"
 	"github.com/ninjasphere/go-ninja/model"
 )
 
 type NodeDevice struct {
+	mu          sync.Mutex
 	info        *model.Module
 	modelDevice *model.Device
+	channels    []*healthChannel
+	// The connection the device was exported on. Exports (and their method subscriptions) last as
+	// long as it does, so it is only exported once.
+	exportedOn *ninja.Connection
+	client     *client
+	replays    nodeCommandReplays
+}
+
+func newNodeDevice(c *client) *NodeDevice {
+	d := &NodeDevice{info: ninja.LoadModuleInfo("./package.json"), client: c}
+	for _, id := range nodeHealthChannels {
+		d.channels = append(d.channels, &healthChannel{id: id})
+	}
+	return d
+}
+
+func (d *NodeDevice) exported() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.exportedOn != nil
+}
+
+func (d *NodeDevice) exportedTo(conn *ninja.Connection) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.exportedOn == conn
+}
+
+func (d *NodeDevice) setExported(conn *ninja.Connection) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.exportedOn = conn
 }
 
 func (d *NodeDevice) GetDeviceInfo() *model.Device {
@@ -0,0 +1,180 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/hashicorp/mdns"
+	"github.com/miekg/dns"
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+// How our services are advertised. One of auto, avahi-file, avahi-dbus or responder. auto uses
+// the avahi service file if avahi is running and its services directory exists, then avahi over
+// D-Bus, and falls back to the built in responder (e.g. on dev machines and in containers, or if
+// avahi fails).
+var advertiserType = config.String("auto", "client", "mdns", "advertiser")
+
+// AdvertisedService is a service advertised over mDNS, under the node's name.
+type AdvertisedService struct {
+	Type string   `json:"type"`
+	Port int      `json:"port"`
+	TXT  []string `json:"txt"`
+}
+
+// Advertiser advertises the node's services over mDNS. Advertise replaces whatever was advertised
+// before.
+type Advertiser interface {
+	Advertise(name string, services []AdvertisedService) error
+	Close() error
+}
+
+var advertiserLock sync.Mutex
+var advertiser Advertiser
+
+// getAdvertiser returns the configured advertiser, creating it the first time.
+func getAdvertiser() (Advertiser, error) {
+	advertiserLock.Lock()
+	defer advertiserLock.Unlock()
+
+	if advertiser != nil {
+		return advertiser, nil
+	}
+
+	var err error
+
+	switch advertiserType {
+	case "avahi-file":
+		advertiser = &avahiFileAdvertiser{path: avahiServiceFile}
+	case "avahi-dbus":
+		advertiser, err = newAvahiDBusAdvertiser()
+	case "responder":
+		advertiser = &responderAdvertiser{}
+	case "auto":
+		if avahiServicesDirExists() && avahiRunning() {
+			advertiser = &avahiFileAdvertiser{path: avahiServiceFile}
+		} else if dbusAdvertiser, dbusErr := newAvahiDBusAdvertiser(); dbusErr == nil {
+			advertiser = dbusAdvertiser
+		} else {
+			log.Infof("Using the built in mDNS responder, as avahi isn't available: %s", dbusErr)
+			advertiser = &responderAdvertiser{}
+		}
+	default:
+		err = fmt.Errorf("Unknown advertiser: %s", advertiserType)
+	}
+
+	if err != nil {
+		// Don't keep a typed nil
+		advertiser = nil
+		return nil, err
+	}
+
+	return advertiser, nil
+}
+
+// fallBackToResponder replaces a failed advertiser with the built in responder, unless it has
+// already been replaced.
+func fallBackToResponder(failed Advertiser) Advertiser {
+	advertiserLock.Lock()
+	defer advertiserLock.Unlock()
+
+	if advertiser == failed {
+		failed.Close()
+		advertiser = &responderAdvertiser{}
+	}
+
+	return advertiser
+}
+
+func servicesFingerprint(name string, services []AdvertisedService) string {
+	data, _ := json.Marshal(services)
+	return name + string(data)
+}
+
+// responderAdvertiser answers mDNS queries itself, for when there is no avahi.
+type responderAdvertiser struct {
+	sync.Mutex
+	server *mdns.Server
+	last   string
+}
+
+// responderZone answers for all of our services.
+type responderZone []mdns.Zone
+
+func (z responderZone) Records(q dns.Question) []dns.RR {
+	var records []dns.RR
+	for _, zone := range z {
+		records = append(records, zone.Records(q)...)
+	}
+	return records
+}
+
+func (a *responderAdvertiser) Advertise(name string, services []AdvertisedService) error {
+	a.Lock()
+	defer a.Unlock()
+
+	fingerprint := servicesFingerprint(name, services)
+	if fingerprint == a.last {
+		return nil
+	}
+
+	ips := localIPs()
+
+	var zone responderZone
+	for _, service := range services {
+		s, err := mdns.NewMDNSService(name, service.Type, "", "", service.Port, ips, service.TXT)
+		if err != nil {
+			return fmt.Errorf("Failed to create mDNS service %s: %s", service.Type, err)
+		}
+		zone = append(zone, s)
+	}
+
+	if a.server != nil {
+		a.server.Shutdown()
+		a.server = nil
+	}
+
+	server, err := mdns.NewServer(&mdns.Config{Zone: zone})
+	if err != nil {
+		return fmt.Errorf("Failed to start mDNS responder: %s", err)
+	}
+
+	a.server = server
+	a.last = fingerprint
+	return nil
+}
+
+func (a *responderAdvertiser) Close() error {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.server == nil {
+		return nil
+	}
+
+	err := a.server.Shutdown()
+	a.server = nil
+	a.last = ""
+	return err
+}
+
+// localIPs returns the addresses we can be reached on.
+func localIPs() []net.IP {
+	var ips []net.IP
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Warningf("Failed to get local addresses: %s", err)
+		return nil
+	}
+
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+
+	return ips
+}
@@ -2,91 +2,272 @@ package client
 
 import (
 	"bytes"
+	"encoding/xml"
+	"fmt"
 	"io/ioutil"
-	"os"
-	"os/exec"
-	"runtime"
+	"path/filepath"
+	"sync"
 	"text/template"
 
+	"github.com/godbus/dbus"
 	"github.com/ninjasphere/go-ninja/config"
 )
 
+var avahiServiceFile = config.String("/data/etc/avahi/services/ninjasphere.service", "client", "mdns", "avahiServiceFile")
+
+var avahiTemplate = template.Must(template.New("avahi").Funcs(template.FuncMap{
+	"xml": func(s string) (string, error) {
+		var buf bytes.Buffer
+		err := xml.EscapeText(&buf, []byte(s))
+		return buf.String(), err
+	},
+}).Parse(src))
+
 var src = `<?xml version="1.0" standalone="no"?>
 <!DOCTYPE service-group SYSTEM "avahi-service.dtd">
 <service-group>
-	<name replace-wildcards="yes">{{.Serial}}</name>
-	{{if .Paired}}
-		{{if .Master}}
+	<name replace-wildcards="yes">{{xml .Name}}</name>
+	{{range .Services}}
 	<service>
-		<type>_ninja-homecloud-rest._tcp</type>
-		<port>{{.RestPort}}</port>
-		<txt-record>ninja.sphere.user_id={{.User}}</txt-record>
-		<txt-record>ninja.sphere.node_id={{.Serial}}</txt-record>
-		<txt-record>ninja.sphere.site_id={{.Site}}</txt-record>
-		<txt-record>ninja.sphere.site_updated={{.SiteUpdated}}</txt-record>
-		<txt-record>ninja.sphere.master=true</txt-record>
-	</service>
+		<type>{{xml .Type}}</type>
+		<port>{{.Port}}</port>
+		{{range .TXT}}
+		<txt-record>{{xml .}}</txt-record>
 		{{end}}
-	<service>
-		<type>_ninja-homecloud-mqtt._tcp</type>
-		<port>1883</port>
-		<txt-record>ninja.sphere.user_id={{.User}}</txt-record>
-		<txt-record>ninja.sphere.node_id={{.Serial}}</txt-record>
-		<txt-record>ninja.sphere.master={{.Master}}</txt-record>
-		<txt-record>ninja.sphere.master_node_id={{.MasterNode}}</txt-record>
-		<txt-record>ninja.sphere.site_id={{.Site}}</txt-record>
-		<txt-record>ninja.sphere.site_updated={{.SiteUpdated}}</txt-record>
-	</service>
-	{{else}}
-	<service>
-		<type>_ninja-setup-assistant-rest._tcp</type>
-		<port>8888</port>
-		<txt-record>ninja.sphere.node_id={{.Serial}}</txt-record>
 	</service>
 	{{end}}
 </service-group>`
 
-func UpdateSphereAvahiService(isPaired, isMaster bool) error {
+// sphereServices returns the services we advertise. Paired nodes advertise their mqtt broker (and
+// the master its rest api), with TXT records describing the mesh. Unpaired nodes advertise the
+// setup assistant.
+func sphereServices(isPaired, isMaster bool) []AdvertisedService {
+
+	if !isPaired {
+		txt := []string{"ninja.sphere.node_id=" + config.Serial()}
+
+		// Tells the other no-cloud nodes we are bootstrapping a site too (see bootstrapOffline).
+		if config.NoCloud() {
+			txt = append(txt, offlineBootstrapTXT)
+		}
+
+		return []AdvertisedService{{
+			Type: "_ninja-setup-assistant-rest._tcp",
+			Port: 8888,
+			TXT:  txt,
+		}}
+	}
+
+	txt := map[string]string{
+		"node_id":        config.Serial(),
+		"user_id":        config.String("", "userId"),
+		"site_id":        config.String("", "siteId"),
+		"site_updated":   fmt.Sprintf("%d", config.Int(0, "siteUpdated")),
+		"master_node_id": config.String("", "masterNodeId"),
+		"master":         fmt.Sprintf("%t", isMaster),
+	}
+
+	var services []AdvertisedService
+
+	if isMaster {
+		services = append(services, AdvertisedService{
+			Type: "_ninja-homecloud-rest._tcp",
+			Port: config.MustInt("homecloud.rest.port"),
+			TXT: []string{
+				"ninja.sphere.user_id=" + txt["user_id"],
+				"ninja.sphere.node_id=" + txt["node_id"],
+				"ninja.sphere.site_id=" + txt["site_id"],
+				"ninja.sphere.site_updated=" + txt["site_updated"],
+				"ninja.sphere.master=true",
+			},
+		})
+	}
 
-	tmpl, err := template.New("avahi").Parse(src)
+	mqtt := AdvertisedService{
+		Type: "_ninja-homecloud-mqtt._tcp",
+		Port: 1883,
+		TXT: []string{
+			"ninja.sphere.user_id=" + txt["user_id"],
+			"ninja.sphere.node_id=" + txt["node_id"],
+			"ninja.sphere.master=" + txt["master"],
+			"ninja.sphere.master_node_id=" + txt["master_node_id"],
+			"ninja.sphere.site_id=" + txt["site_id"],
+			"ninja.sphere.site_updated=" + txt["site_updated"],
+		},
+	}
 
+	// Lets siblings check our site updates really come from a node in the mesh.
+	if key, err := networkKey(); err == nil {
+		mqtt.TXT = append(mqtt.TXT, "ninja.sphere.mesh_sig="+meshTXTSignature(key, txt))
+	} else {
+		log.Warningf("Not signing mDNS records: %s", err)
+	}
+
+	if isMaster && localPairingAllowed() {
+		mqtt.TXT = append(mqtt.TXT, fmt.Sprintf("ninja.sphere.pairing_port=%d", localPairingPort))
+	}
+
+	return append(services, mqtt)
+}
+
+// UpdateSphereAvahiService advertises our services using the configured Advertiser. If avahi was
+// picked automatically and fails, we fall back to the built in responder.
+func UpdateSphereAvahiService(isPaired, isMaster bool) error {
+
+	advertiser, err := getAdvertiser()
 	if err != nil {
 		return err
 	}
 
+	services := sphereServices(isPaired, isMaster)
+
+	err = advertiser.Advertise(config.Serial(), services)
+	if err == nil || advertiserType != "auto" {
+		return err
+	}
+
+	if _, ok := advertiser.(*responderAdvertiser); ok {
+		return err
+	}
+
+	log.Warningf("Falling back to the built in mDNS responder: %s", err)
+
+	return fallBackToResponder(advertiser).Advertise(config.Serial(), services)
+}
+
+// avahiFileAdvertiser writes an avahi service definition, and asks avahi to reload it. The file is
+// only written (and avahi reloaded) if it has changed.
+type avahiFileAdvertiser struct {
+	path string
+}
+
+func (a *avahiFileAdvertiser) Advertise(name string, services []AdvertisedService) error {
+
 	serviceDefinition := new(bytes.Buffer)
 
-	err = tmpl.Execute(serviceDefinition, map[string]interface{}{
-		"Serial":      config.Serial(),
-		"Master":      isMaster,
-		"Paired":      isPaired,
-		"User":        config.String("", "userId"),
-		"Site":        config.String("", "siteId"),
-		"MasterNode":  config.String("", "masterNodeId"),
-		"SiteUpdated": config.Int(0, "siteUpdated"),
-		"RestPort":    config.MustInt("homecloud.rest.port"),
+	err := avahiTemplate.Execute(serviceDefinition, map[string]interface{}{
+		"Name":     name,
+		"Services": services,
 	})
 
 	if err != nil {
 		return err
 	}
 
-	log.Debugf("Saving service definition", serviceDefinition.String())
-
-	if runtime.GOOS != "linux" {
-		log.Warningf("Avahi service definition is not being saved, as platform != linux")
+	if existing, err := ioutil.ReadFile(a.path); err == nil && bytes.Equal(existing, serviceDefinition.Bytes()) {
+		log.Debugf("Avahi service definition hasn't changed")
 		return nil
 	}
 
-	if _, err := os.Stat("/data/etc/avahi/services"); err != nil {
-		log.Warningf("Avahi service definition is not being saved, as /data/etc/avahi/services does not exist")
+	log.Debugf("Saving service definition: %s", serviceDefinition.String())
+
+	if err := writeFileAtomic(a.path, serviceDefinition.Bytes(), 0644); err != nil {
+		return fmt.Errorf("Failed to save avahi service definition: %s", err)
+	}
+
+	if _, err := runCommand("avahi-daemon", "--reload"); err != nil {
+		return fmt.Errorf("Failed to reload avahi: %s", err)
+	}
+
+	return nil
+}
+
+func (a *avahiFileAdvertiser) Close() error {
+	return nil
+}
+
+func avahiServicesDirExists() bool {
+	_, err := ioutil.ReadDir(filepath.Dir(avahiServiceFile))
+	return err == nil
+}
+
+// avahiRunning returns whether the avahi daemon is running, to reload our service file.
+func avahiRunning() bool {
+	_, err := runCommand("avahi-daemon", "--check")
+	return err == nil
+}
+
+const (
+	avahiBus        = "org.freedesktop.Avahi"
+	avahiIfUnspec   = int32(-1)
+	avahiProtoUnpec = int32(-1)
+)
+
+// avahiDBusAdvertiser registers our services with avahi over D-Bus, in an entry group that is
+// reset and recommitted whenever they change.
+type avahiDBusAdvertiser struct {
+	sync.Mutex
+	conn  *dbus.Conn
+	group dbus.BusObject
+	last  string
+}
+
+func newAvahiDBusAdvertiser() (*avahiDBusAdvertiser, error) {
+
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to the system bus: %s", err)
+	}
+
+	server := conn.Object(avahiBus, "/")
+
+	var version string
+	if err := server.Call(avahiBus+".Server.GetVersionString", 0).Store(&version); err != nil {
+		return nil, fmt.Errorf("Avahi isn't available over D-Bus: %s", err)
+	}
+
+	var path dbus.ObjectPath
+	if err := server.Call(avahiBus+".Server.EntryGroupNew", 0).Store(&path); err != nil {
+		return nil, fmt.Errorf("Failed to create avahi entry group: %s", err)
+	}
+
+	log.Infof("Advertising with %s over D-Bus", version)
+
+	return &avahiDBusAdvertiser{
+		conn:  conn,
+		group: conn.Object(avahiBus, path),
+	}, nil
+}
+
+func (a *avahiDBusAdvertiser) Advertise(name string, services []AdvertisedService) error {
+	a.Lock()
+	defer a.Unlock()
+
+	fingerprint := servicesFingerprint(name, services)
+	if fingerprint == a.last {
 		return nil
 	}
 
-	err = ioutil.WriteFile("/data/etc/avahi/services/ninjasphere.service", []byte(serviceDefinition.String()), 0644)
+	if err := a.group.Call(avahiBus+".EntryGroup.Reset", 0).Err; err != nil {
+		return fmt.Errorf("Failed to reset avahi entry group: %s", err)
+	}
+
+	for _, service := range services {
+		txt := make([][]byte, len(service.TXT))
+		for i, record := range service.TXT {
+			txt[i] = []byte(record)
+		}
+
+		err := a.group.Call(avahiBus+".EntryGroup.AddService", 0,
+			avahiIfUnspec, avahiProtoUnpec, uint32(0),
+			name, service.Type, "", "", uint16(service.Port), txt).Err
+		if err != nil {
+			return fmt.Errorf("Failed to add %s to avahi entry group: %s", service.Type, err)
+		}
+	}
+
+	if err := a.group.Call(avahiBus+".EntryGroup.Commit", 0).Err; err != nil {
+		return fmt.Errorf("Failed to commit avahi entry group: %s", err)
+	}
+
+	a.last = fingerprint
+	return nil
+}
 
-	// HACK: Remove this if it doesn't fix Chris's problem
-	exec.Command("service", "avahi-daemon", "restart").Output()
+func (a *avahiDBusAdvertiser) Close() error {
+	a.Lock()
+	defer a.Unlock()
 
-	return err
+	a.group.Call(avahiBus+".EntryGroup.Free", 0)
+	return a.conn.Close()
 }
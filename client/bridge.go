@@ -0,0 +1,306 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/bus"
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+// How long the master connection can be down before the bridge is torn down and reconnected.
+var bridgeGracePeriod = config.Duration(time.Second*5, "client", "bridge", "gracePeriod")
+
+var bridgeRetry = loadRetryPolicy("bridge", retryPolicy{
+	Initial:    time.Second,
+	Max:        time.Second * 30,
+	Multiplier: 2,
+	Jitter:     0.3,
+})
+
+// How often the bridge checks its connections are up.
+var bridgeCheckInterval = time.Second
+
+var errBridgeClosed = errors.New("Bridge closed")
+
+// meshBridgeHealth is published on $node/<serial>/client/bridge whenever the bridge connects or
+// disconnects.
+type meshBridgeHealth struct {
+	Connected  bool   `json:"connected"`
+	Master     string `json:"master"`
+	Reconnects int    `json:"reconnects"`
+	Since      int64  `json:"since"`
+	LastError  string `json:"lastError,omitempty"`
+}
+
+// bridgeFilter decides whether a message is passed across the bridge, and what it looks like on
+// the other side.
+type bridgeFilter func(masterToSlave bool, topic string, payload []byte) ([]byte, bool)
+
+// meshBridge owns the connections to the local and master mqtt brokers, and copies messages
+// between them according to the bridge rules. If either connection drops for longer than the grace period,
+// both are torn down and reconnected (with backoff), and the topics subscribed again.
+type meshBridge struct {
+	sync.Mutex
+	masterURL string
+	clientID  string
+	localURL  string
+	rules     []bridgeRule
+	filter    bridgeFilter
+	onHealth  func(meshBridgeHealth)
+	retry     func(*retryPolicy, func() error) error
+
+	// If set, the master must pass authenticate before anything is bridged.
+	authenticate func(masterBus bus.Bus, masterURL string) error
+	// If set, the username and password used to log in to the master broker.
+	masterLogin *bus.ClientOptions
+
+	masterBus     bus.Bus
+	localBus      bus.Bus
+	health        meshBridgeHealth
+	everConnected bool
+	closed        bool
+	stop          chan struct{}
+	// Closed once the bridge has disconnected after being closed.
+	stopped chan struct{}
+}
+
+func newMeshBridge(masterURL, clientID, localURL string, rules []bridgeRule, filter bridgeFilter, onHealth func(meshBridgeHealth), retry func(*retryPolicy, func() error) error) *meshBridge {
+	return &meshBridge{
+		masterURL: masterURL,
+		clientID:  clientID,
+		localURL:  localURL,
+		rules:     rules,
+		filter:    filter,
+		onHealth:  onHealth,
+		retry:     retry,
+		health:    meshBridgeHealth{Master: masterURL},
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+}
+
+func (b *meshBridge) start() {
+	go b.supervise()
+}
+
+// close disconnects the bridge for good.
+func (b *meshBridge) close() {
+	b.Lock()
+	defer b.Unlock()
+
+	if !b.closed {
+		b.closed = true
+		close(b.stop)
+	}
+}
+
+// setMaster changes the address of the master broker, used the next time the bridge connects.
+func (b *meshBridge) setMaster(masterURL string) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.masterURL != masterURL {
+		log.Infof("Master has moved from %s to %s", b.masterURL, masterURL)
+		b.masterURL = masterURL
+	}
+}
+
+func (b *meshBridge) getHealth() meshBridgeHealth {
+	b.Lock()
+	defer b.Unlock()
+	return b.health
+}
+
+func (b *meshBridge) isClosed() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.closed
+}
+
+func (b *meshBridge) supervise() {
+	defer close(b.stopped)
+
+	for {
+		err := b.retry(bridgeRetry, func() error {
+			if b.isClosed() {
+				return permanent(errBridgeClosed)
+			}
+
+			err := b.connect()
+			if err != nil {
+				b.setHealth(false, err)
+			}
+			return err
+		})
+
+		if err == errBridgeClosed || b.isClosed() {
+			b.disconnect()
+			return
+		}
+
+		b.setHealth(true, nil)
+
+		if !b.monitor() {
+			b.disconnect()
+			return
+		}
+
+		b.disconnect()
+	}
+}
+
+// monitor watches the connections until one has been down for longer than the grace period
+// (returning true), or the bridge is closed (returning false).
+func (b *meshBridge) monitor() bool {
+
+	var down time.Time
+
+	for {
+		select {
+		case <-b.stop:
+			return false
+		case <-time.After(bridgeCheckInterval):
+		}
+
+		b.Lock()
+		connected := b.masterBus.Connected() && b.localBus.Connected()
+		b.Unlock()
+
+		if connected {
+			down = time.Time{}
+			continue
+		}
+
+		if down.IsZero() {
+			log.Infof("Bridge to master is down")
+			down = time.Now()
+		} else if time.Since(down) > bridgeGracePeriod {
+			log.Infof("Bridge to master has been down for %s, reconnecting", time.Since(down))
+			b.setHealth(false, errors.New("Disconnected"))
+			return true
+		}
+	}
+}
+
+func (b *meshBridge) connect() error {
+
+	b.Lock()
+	masterURL := b.masterURL
+	b.Unlock()
+
+	log.Infof("Connecting to master %s using cid:%s", masterURL, b.clientID)
+
+	masterBus, err := connectBus(masterURL, b.clientID, b.masterLogin)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to master at %s: %s", masterURL, err)
+	}
+
+	localBus, err := connectBus(b.localURL, "meshing", nil)
+	if err != nil {
+		masterBus.Destroy()
+		return fmt.Errorf("Failed to connect to local broker at %s: %s", b.localURL, err)
+	}
+
+	b.Lock()
+	b.masterBus, b.localBus = masterBus, localBus
+	b.Unlock()
+
+	log.Infof("Connected to master? %t", masterBus.Connected())
+
+	if !masterBus.Connected() {
+		b.disconnect()
+		return fmt.Errorf("Failed to connect to master at %s", masterURL)
+	}
+
+	if b.authenticate != nil {
+		if err := b.authenticate(masterBus, masterURL); err != nil {
+			log.Warningf("Refusing to bridge to master at %s: %s", masterURL, err)
+			b.disconnect()
+			return err
+		}
+	}
+
+	if err := b.subscribe(masterBus, localBus, true); err != nil {
+		b.disconnect()
+		return err
+	}
+
+	if err := b.subscribe(localBus, masterBus, false); err != nil {
+		b.disconnect()
+		return err
+	}
+
+	return nil
+}
+
+func (b *meshBridge) subscribe(from, to bus.Bus, masterToSlave bool) error {
+
+	for _, rule := range b.rules {
+		if !rule.bridges(masterToSlave) {
+			continue
+		}
+
+		prefix := rule.Prefix
+		onMessage := func(topic string, payload []byte) {
+			if payload, ok := b.filter(masterToSlave, topic, payload); ok {
+				to.Publish(prefix+topic, payload)
+			}
+		}
+
+		_, err := from.Subscribe(rule.Topic, onMessage)
+		if err != nil {
+			return fmt.Errorf("Failed to subscribe to topic %s when bridging to master: %s", rule.Topic, err)
+		}
+	}
+
+	return nil
+}
+
+func (b *meshBridge) disconnect() {
+	b.Lock()
+	localBus, masterBus := b.localBus, b.masterBus
+	b.localBus, b.masterBus = nil, nil
+	b.Unlock()
+
+	if localBus != nil {
+		localBus.Destroy()
+	}
+	if masterBus != nil {
+		masterBus.Destroy()
+	}
+}
+
+func (b *meshBridge) setHealth(connected bool, err error) {
+	b.Lock()
+
+	changed := b.health.Connected != connected
+
+	if changed {
+		b.health.Since = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+
+	if changed && connected {
+		if b.everConnected {
+			b.health.Reconnects++
+		}
+		b.everConnected = true
+	}
+
+	b.health.Connected = connected
+	b.health.Master = b.masterURL
+	b.health.LastError = ""
+	if err != nil {
+		b.health.LastError = err.Error()
+	}
+
+	health := b.health
+	closed := b.closed
+	b.Unlock()
+
+	if changed && !closed && b.onHealth != nil {
+		b.onHealth(health)
+	}
+}
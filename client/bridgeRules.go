@@ -0,0 +1,97 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+type bridgeDirection string
+
+const (
+	bridgeBoth          bridgeDirection = "both"
+	bridgeMasterToSlave bridgeDirection = "master-to-slave"
+	bridgeSlaveToMaster bridgeDirection = "slave-to-master"
+)
+
+// bridgeRule says which way messages on a topic pattern are bridged. If Prefix is set, it is
+// prepended to the topic on the other side. It is only prepended: the topic isn't otherwise
+// rewritten, and nothing strips the prefix from messages bridged back, so "$device/# both $mesh/"
+// publishes $device/x as $mesh/$device/x and $mesh/$device/x is not bridged back as $device/x.
+type bridgeRule struct {
+	Topic     string
+	Direction bridgeDirection
+	Prefix    string
+}
+
+func (r bridgeRule) bridges(masterToSlave bool) bool {
+	switch r.Direction {
+	case bridgeBoth:
+		return true
+	case bridgeMasterToSlave:
+		return masterToSlave
+	case bridgeSlaveToMaster:
+		return !masterToSlave
+	}
+	return false
+}
+
+// $home/# is deprecated, and can be dropped by configuring the rules without it.
+const defaultBridgeRules = "$discover, $site/#, $home/#, $node/#, $thing/#, $device/#"
+
+// The bridge rules, as a comma separated list of "<topic> [direction] [prefix]", where direction
+// is one of both (the default), master-to-slave or slave-to-master, and prefix is prepended to
+// the topic of bridged messages.
+// e.g. "$discover, $node/# slave-to-master, $device/# both $mesh/"
+var bridgeRulesConfig = config.String(defaultBridgeRules, "client", "bridge", "rules")
+
+// loadBridgeRules returns the configured bridge rules, or the default ones if they are invalid.
+func loadBridgeRules() []bridgeRule {
+	rules, err := parseBridgeRules(bridgeRulesConfig)
+	if err != nil {
+		log.Warningf("Invalid client.bridge.rules, using the defaults: %s", err)
+		rules, _ = parseBridgeRules(defaultBridgeRules)
+	}
+	return rules
+}
+
+// parseBridgeRules parses rules in the format used by client.bridge.rules
+func parseBridgeRules(spec string) ([]bridgeRule, error) {
+	var rules []bridgeRule
+
+	for _, part := range strings.Split(spec, ",") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("Invalid bridge rule '%s' (too many fields)", part)
+		}
+
+		rule := bridgeRule{
+			Topic:     fields[0],
+			Direction: bridgeBoth,
+		}
+
+		if len(fields) > 1 {
+			rule.Direction = bridgeDirection(fields[1])
+			if rule.Direction != bridgeBoth && rule.Direction != bridgeMasterToSlave && rule.Direction != bridgeSlaveToMaster {
+				return nil, fmt.Errorf("Invalid direction '%s' in bridge rule '%s'", fields[1], part)
+			}
+		}
+
+		if len(fields) > 2 {
+			rule.Prefix = fields[2]
+		}
+
+		rules = append(rules, rule)
+	}
+
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("No bridge rules in '%s'", spec)
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,158 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBridgeRules(t *testing.T) {
+	tests := []struct {
+		spec  string
+		rules []bridgeRule
+		valid bool
+	}{
+		{
+			spec: "$discover, $node/#",
+			rules: []bridgeRule{
+				{Topic: "$discover", Direction: bridgeBoth},
+				{Topic: "$node/#", Direction: bridgeBoth},
+			},
+			valid: true,
+		},
+		{
+			spec: "$node/# slave-to-master, $site/# master-to-slave, $thing/# both",
+			rules: []bridgeRule{
+				{Topic: "$node/#", Direction: bridgeSlaveToMaster},
+				{Topic: "$site/#", Direction: bridgeMasterToSlave},
+				{Topic: "$thing/#", Direction: bridgeBoth},
+			},
+			valid: true,
+		},
+		{
+			spec: "$device/# both $mesh/",
+			rules: []bridgeRule{
+				{Topic: "$device/#", Direction: bridgeBoth, Prefix: "$mesh/"},
+			},
+			valid: true,
+		},
+		{
+			// Empty parts are skipped
+			spec: " $discover ,, \t$node/#  , ",
+			rules: []bridgeRule{
+				{Topic: "$discover", Direction: bridgeBoth},
+				{Topic: "$node/#", Direction: bridgeBoth},
+			},
+			valid: true,
+		},
+		{spec: "$node/# upstream"},
+		{spec: "$node/# Both"},
+		{spec: "$device/# both $mesh/ extra"},
+		{spec: ""},
+		{spec: " , ,"},
+	}
+
+	for _, test := range tests {
+		rules, err := parseBridgeRules(test.spec)
+
+		if !test.valid {
+			if err == nil {
+				t.Errorf("Expected '%s' to be invalid, got %+v", test.spec, rules)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Failed to parse '%s': %s", test.spec, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(rules, test.rules) {
+			t.Errorf("Unexpected rules for '%s': %+v", test.spec, rules)
+		}
+	}
+}
+
+func TestDefaultBridgeRules(t *testing.T) {
+	rules, err := parseBridgeRules(defaultBridgeRules)
+	if err != nil {
+		t.Fatalf("Failed to parse the default rules: %s", err)
+	}
+
+	for _, rule := range rules {
+		if rule.Direction != bridgeBoth || rule.Prefix != "" {
+			t.Errorf("Unexpected default rule %+v", rule)
+		}
+	}
+}
+
+func TestBridgeRuleDirections(t *testing.T) {
+	tests := []struct {
+		direction                    bridgeDirection
+		masterToSlave, slaveToMaster bool
+	}{
+		{bridgeBoth, true, true},
+		{bridgeMasterToSlave, true, false},
+		{bridgeSlaveToMaster, false, true},
+		{bridgeDirection("upstream"), false, false},
+	}
+
+	for _, test := range tests {
+		rule := bridgeRule{Topic: "$node/#", Direction: test.direction}
+		if rule.bridges(true) != test.masterToSlave || rule.bridges(false) != test.slaveToMaster {
+			t.Errorf("Unexpected directions for %s", test.direction)
+		}
+	}
+}
+
+// TestBridgeRulePrefixIsPrepended checks that a rule's prefix is only prepended to the topics it
+// bridges, and isn't stripped from messages coming back.
+func TestBridgeRulePrefixIsPrepended(t *testing.T) {
+	master, local := &fakeBroker{}, &fakeBroker{}
+	defer withFakeBrokers(master, local)()
+
+	passThrough := func(masterToSlave bool, topic string, payload []byte) ([]byte, bool) {
+		return payload, true
+	}
+
+	rules := []bridgeRule{{Topic: "$device/#", Direction: bridgeBoth, Prefix: "$mesh/"}}
+	bridge := newMeshBridge("master:1883", "slave-test", "local:1883", rules, passThrough, nil, fastRetry)
+
+	localMessages := &received{}
+	localSub, _ := local.connect("watcher")
+	localSub.Subscribe("#", localMessages.add)
+
+	masterMessages := &received{}
+	masterSub, _ := master.connect("watcher")
+	masterSub.Subscribe("#", masterMessages.add)
+
+	bridge.start()
+	defer func() {
+		bridge.close()
+		<-bridge.stopped
+	}()
+
+	waitFor(t, "the bridge to connect", func() bool { return bridge.getHealth().Connected })
+
+	local.publish("$device/slave-device/event/state", []byte(`"on"`))
+	waitFor(t, "a message to the master", func() bool { return masterMessages.count() == 1 })
+
+	// Already prefixed, so it doesn't match the rule and isn't bridged back without the prefix.
+	master.publish("$mesh/$device/slave-device/event/state", []byte(`"on"`))
+	master.publish("$device/master-device/event/state", []byte(`"off"`))
+	waitFor(t, "a message from the master", func() bool { return localMessages.count() == 2 })
+
+	masterMessages.Lock()
+	defer masterMessages.Unlock()
+	localMessages.Lock()
+	defer localMessages.Unlock()
+
+	expectedMaster := []string{"$mesh/$device/slave-device/event/state", "$mesh/$device/slave-device/event/state", "$device/master-device/event/state"}
+	if !reflect.DeepEqual(masterMessages.topics, expectedMaster) {
+		t.Fatalf("Unexpected topics on the master: %v", masterMessages.topics)
+	}
+
+	expectedLocal := []string{"$device/slave-device/event/state", "$mesh/$device/master-device/event/state"}
+	if !reflect.DeepEqual(localMessages.topics, expectedLocal) {
+		t.Fatalf("Unexpected topics on the slave: %v", localMessages.topics)
+	}
+}
@@ -0,0 +1,399 @@
+package client
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/bus"
+)
+
+// fakeBroker is an in-memory mqtt broker. Taking it down disconnects every client.
+type fakeBroker struct {
+	sync.Mutex
+	down    bool
+	clients []*fakeBus
+}
+
+type fakeSubscription struct {
+	topic    string
+	callback func(topic string, payload []byte)
+}
+
+// fakeBus is a connection to a fakeBroker.
+type fakeBus struct {
+	sync.Mutex
+	broker        *fakeBroker
+	id            string
+	connected     bool
+	subscriptions []fakeSubscription
+}
+
+var errBrokerDown = errors.New("Connection refused")
+
+func (b *fakeBroker) connect(id string) (bus.Bus, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.down {
+		return nil, errBrokerDown
+	}
+
+	c := &fakeBus{broker: b, id: id, connected: true}
+	b.clients = append(b.clients, c)
+	return c, nil
+}
+
+func (b *fakeBroker) setDown(down bool) {
+	b.Lock()
+	b.down = down
+	clients := b.clients
+	if down {
+		b.clients = nil
+	}
+	b.Unlock()
+
+	if down {
+		for _, c := range clients {
+			c.Lock()
+			c.connected = false
+			c.Unlock()
+		}
+	}
+}
+
+func (b *fakeBroker) publish(topic string, payload []byte) {
+	b.Lock()
+	clients := append([]*fakeBus{}, b.clients...)
+	b.Unlock()
+
+	for _, c := range clients {
+		c.Lock()
+		var callbacks []func(string, []byte)
+		for _, sub := range c.subscriptions {
+			if c.connected && topicMatches(sub.topic, topic) {
+				callbacks = append(callbacks, sub.callback)
+			}
+		}
+		c.Unlock()
+
+		for _, cb := range callbacks {
+			cb(topic, payload)
+		}
+	}
+}
+
+// topicMatches matches an mqtt topic against a pattern with + and # wildcards.
+func topicMatches(pattern, topic string) bool {
+	p, t := strings.Split(pattern, "/"), strings.Split(topic, "/")
+	for i, part := range p {
+		if part == "#" {
+			return true
+		}
+		if i >= len(t) || (part != "+" && part != t[i]) {
+			return false
+		}
+	}
+	return len(p) == len(t)
+}
+
+func (c *fakeBus) Publish(topic string, payload []byte) {
+	if c.Connected() {
+		c.broker.publish(topic, payload)
+	}
+}
+
+func (c *fakeBus) Subscribe(topic string, callback func(topic string, payload []byte)) (*bus.Subscription, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.subscriptions = append(c.subscriptions, fakeSubscription{topic, callback})
+	return &bus.Subscription{}, nil
+}
+
+func (c *fakeBus) OnDisconnect(cb func()) {}
+func (c *fakeBus) OnConnect(cb func())    {}
+
+func (c *fakeBus) Connected() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.connected
+}
+
+func (c *fakeBus) Destroy() {
+	c.Lock()
+	c.connected = false
+	c.subscriptions = nil
+	c.Unlock()
+}
+
+// withFakeBrokers makes the bridge connect to the fake brokers, and speeds up its timing, until the
+// returned func is called.
+func withFakeBrokers(master, local *fakeBroker) func() {
+	oldConnect, oldInterval, oldGrace := connectBus, bridgeCheckInterval, bridgeGracePeriod
+
+	connectBus = func(host, id string, opts *bus.ClientOptions) (bus.Bus, error) {
+		if strings.HasPrefix(host, "master") {
+			return master.connect(id)
+		}
+		return local.connect(id)
+	}
+	bridgeCheckInterval = time.Millisecond * 10
+	bridgeGracePeriod = time.Millisecond * 50
+
+	return func() {
+		connectBus, bridgeCheckInterval, bridgeGracePeriod = oldConnect, oldInterval, oldGrace
+	}
+}
+
+var testRetry = &retryPolicy{Name: "test", Initial: time.Millisecond * 10, Max: time.Millisecond * 50, Multiplier: 2}
+
+func fastRetry(_ *retryPolicy, op func() error) error {
+	return testRetry.run(op, nil)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second * 5)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+// received collects the messages published on a broker.
+type received struct {
+	sync.Mutex
+	topics []string
+}
+
+func (r *received) add(topic string, payload []byte) {
+	r.Lock()
+	r.topics = append(r.topics, topic)
+	r.Unlock()
+}
+
+func (r *received) count() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.topics)
+}
+
+// TestOrphanUnorphanRebridge runs a slave's bridge through losing the master and getting it back,
+// with the state machine wired up the way the client does it. The hooks are slow, like starting
+// and stopping services, and must not hold up the transitions reported by the bridge.
+func TestOrphanUnorphanRebridge(t *testing.T) {
+	master, local := &fakeBroker{}, &fakeBroker{}
+	defer withFakeBrokers(master, local)()
+
+	state := newStateMachine(stateSlaveSearching)
+
+	var hooksLock sync.Mutex
+	var seen []clientState
+	state.onTransition(func(from, to clientState) {
+		time.Sleep(time.Millisecond * 100)
+		hooksLock.Lock()
+		seen = append(seen, to)
+		hooksLock.Unlock()
+	})
+
+	var transitionTimes sync.Mutex
+	var slowest time.Duration
+	transition := func(to clientState) {
+		started := time.Now()
+		state.transition(to)
+
+		transitionTimes.Lock()
+		if took := time.Since(started); took > slowest {
+			slowest = took
+		}
+		transitionTimes.Unlock()
+	}
+
+	// The real filter, which unorphans us when we hear from the master.
+	c := &client{state: state}
+	filter := c.filterBridgeMessage
+
+	onHealth := func(health meshBridgeHealth) {
+		if health.Connected {
+			transition(stateSlaveBridged)
+		} else {
+			transition(stateOrphaned)
+		}
+	}
+
+	rules := []bridgeRule{{Topic: "$node/#", Direction: bridgeBoth}}
+	bridge := newMeshBridge("master:1883", "slave-test", "local:1883", rules, filter, onHealth, fastRetry)
+
+	localMessages := &received{}
+	localSub, _ := local.connect("watcher")
+	localSub.Subscribe("$node/#", localMessages.add)
+
+	masterMessages := &received{}
+	masterSub, _ := master.connect("watcher")
+	masterSub.Subscribe("$node/#", masterMessages.add)
+
+	bridge.start()
+	defer func() {
+		bridge.close()
+		<-bridge.stopped
+	}()
+
+	waitFor(t, "the bridge to connect", func() bool { return state.is(stateSlaveBridged) })
+
+	master.publish("$node/master/event", []byte(`"hello"`))
+	waitFor(t, "a message from the master", func() bool { return localMessages.count() == 1 })
+
+	// Lose the master
+	master.setDown(true)
+	waitFor(t, "the slave to be orphaned", func() bool { return state.is(stateOrphaned) })
+
+	if health := bridge.getHealth(); health.Connected {
+		t.Fatalf("Expected the bridge to be down, got %+v", health)
+	}
+
+	// Get it back. The bridge reconnects by itself, and subscribes again.
+	master.setDown(false)
+	masterSub, _ = master.connect("watcher")
+	masterSub.Subscribe("$node/#", masterMessages.add)
+
+	waitFor(t, "the slave to be unorphaned", func() bool { return state.is(stateSlaveBridged) })
+
+	if health := bridge.getHealth(); !health.Connected || health.Reconnects != 1 {
+		t.Fatalf("Expected the bridge to have reconnected once, got %+v", health)
+	}
+
+	master.publish("$node/master/event", []byte(`"again"`))
+	waitFor(t, "a message from the master after rebridging", func() bool { return localMessages.count() == 2 })
+
+	local.publish("$node/slave/event", []byte(`"up"`))
+	waitFor(t, "a message to the master after rebridging", func() bool { return masterMessages.count() >= 1 })
+
+	state.wait()
+
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+
+	expected := []clientState{stateSlaveBridged, stateOrphaned, stateSlaveBridged}
+	if len(seen) != len(expected) {
+		t.Fatalf("Expected hooks for %v, got %v", expected, seen)
+	}
+	for i := range expected {
+		if seen[i] != expected[i] {
+			t.Fatalf("Expected hooks for %v, got %v", expected, seen)
+		}
+	}
+
+	transitionTimes.Lock()
+	defer transitionTimes.Unlock()
+	if slowest > time.Millisecond*50 {
+		t.Fatalf("A transition took %s, so was held up by the hooks", slowest)
+	}
+}
+
+// TestBridgeClosedWhileOrphaned makes sure a closed bridge stops trying to reconnect.
+func TestBridgeClosedWhileOrphaned(t *testing.T) {
+	master, local := &fakeBroker{down: true}, &fakeBroker{}
+	defer withFakeBrokers(master, local)()
+
+	var attempts sync.Mutex
+	connects := 0
+	retry := func(p *retryPolicy, op func() error) error {
+		return fastRetry(p, func() error {
+			attempts.Lock()
+			connects++
+			attempts.Unlock()
+			return op()
+		})
+	}
+
+	bridge := newMeshBridge("master:1883", "slave-test", "local:1883", nil, nil, nil, retry)
+	bridge.start()
+
+	waitFor(t, "a few connection attempts", func() bool {
+		attempts.Lock()
+		defer attempts.Unlock()
+		return connects > 2
+	})
+
+	bridge.close()
+
+	select {
+	case <-bridge.stopped:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Bridge kept connecting after being closed")
+	}
+}
+
+func TestStateHooksRunInOrder(t *testing.T) {
+	state := newStateMachine(stateSlaveSearching)
+
+	var lock sync.Mutex
+	var seen []clientState
+	state.onTransition(func(from, to clientState) {
+		lock.Lock()
+		seen = append(seen, to)
+		lock.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state.transition(stateOrphaned)
+			state.transition(stateSlaveBridged)
+		}()
+	}
+	wg.Wait()
+	state.wait()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	for i := 1; i < len(seen); i++ {
+		if seen[i] == seen[i-1] {
+			t.Fatalf("Hooks ran out of order: %v", seen)
+		}
+	}
+
+	if last := seen[len(seen)-1]; last != state.current() {
+		t.Fatalf("Last hook was for %s, but the state is %s", last, state.current())
+	}
+}
+
+func TestBridgeLogsInToMaster(t *testing.T) {
+	master, local := &fakeBroker{}, &fakeBroker{}
+	defer withFakeBrokers(master, local)()
+
+	logins := make(chan *bus.ClientOptions, 1)
+	connect := connectBus
+	connectBus = func(host, id string, opts *bus.ClientOptions) (bus.Bus, error) {
+		if strings.HasPrefix(host, "master") {
+			select {
+			case logins <- opts:
+			default:
+			}
+		}
+		return connect(host, id, opts)
+	}
+
+	bridge := newMeshBridge("master:1883", "slave-test", "local:1883", nil, nil, nil, fastRetry)
+	bridge.masterLogin = &bus.ClientOptions{Username: "slave-test", Password: "secret"}
+	bridge.start()
+	defer func() {
+		bridge.close()
+		<-bridge.stopped
+	}()
+
+	select {
+	case login := <-logins:
+		if login == nil || login.Username != "slave-test" || login.Password != "secret" {
+			t.Fatalf("Unexpected login: %+v", login)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Timed out waiting for the bridge to connect")
+	}
+}
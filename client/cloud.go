@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/ninjasphere/go-ninja/config"
@@ -25,6 +27,23 @@ type Site struct {
 }
 
 var errorUnauthorised = errors.New("Unauthorised token")
+var errorUnpairUnsupported = errors.New("No unpair url configured")
+
+// CloudAPI is the part of the Ninja cloud used by the client. The default implementation talks
+// to the REST api over http, but anything that speaks the same language (i.e. a fake cloud in
+// tests) can be swapped in using StartWithCloud.
+type CloudAPI interface {
+	// Nodes returns the nodes owned by the paired user, keyed by node id.
+	Nodes() (map[string]Node, error)
+	// Sites returns the sites owned by the paired user, keyed by site id.
+	Sites() (map[string]Site, error)
+	// Activate claims this node. It returns nil credentials (and no error) if the activation
+	// request timed out waiting for the user, in which case it should be called again. Closing
+	// cancel abandons the request.
+	Activate(nodeID, localIP, boardType string, cancel <-chan struct{}) (*Credentials, error)
+	// Unpair removes the node from the paired user's account.
+	Unpair(nodeID string) error
+}
 
 type nTime time.Time
 
@@ -45,7 +64,7 @@ func (jt *nTime) UnmarshalJSON(data []byte) error {
 type restError struct {
 	Type    string `json:"type"`
 	Code    int    `json:"code"`
-	Message int    `json:"message"`
+	Message string `json:"message"`
 }
 
 type restResponse struct {
@@ -53,9 +72,77 @@ type restResponse struct {
 	Data json.RawMessage `json:"data"`
 }
 
-func getNodes() (map[string]Node, error) {
+type httpCloud struct {
+	baseURL string
+	// urls overrides the urls in the "cloud" config section, by key.
+	urls       map[string]string
+	rest       *http.Client
+	activation *http.Client
+}
+
+// NewHTTPCloud returns a CloudAPI that uses the urls in the "cloud" config section. If baseURL
+// is not empty, the scheme and host of each of those urls are replaced with its own (so a node can be
+// pointed at a local stand-in). If transport is nil, the default transport is used (or one that
+// skips certificate verification if cloud.allowSelfSigned is set).
+func NewHTTPCloud(baseURL string, transport http.RoundTripper) (CloudAPI, error) {
+
+	c := &httpCloud{}
+
+	if baseURL != "" {
+		if _, err := url.Parse(baseURL); err != nil {
+			return nil, fmt.Errorf("Invalid cloud base url %s: %s", baseURL, err)
+		}
+		c.baseURL = baseURL
+	}
+
+	if transport == nil && config.Bool(false, "cloud", "allowSelfSigned") {
+		log.Warningf("Allowing self-signed cerificate (should only be used to connect to development cloud)")
+		transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+
+	c.rest = &http.Client{
+		Transport: transport,
+		Timeout:   time.Second * 30,
+	}
+
+	c.activation = &http.Client{
+		Transport: transport,
+		Timeout:   time.Second * 60, // It's 20sec on the server so this *should* be ok
+	}
+
+	return c, nil
+}
+
+// url returns the configured cloud url with the given key, rebased onto the base url if we have one.
+// The urls are format strings, so they are rebased by hand rather than parsed.
+func (c *httpCloud) url(key string) string {
+	raw, ok := c.urls[key]
+	if !ok {
+		raw = config.MustString("cloud", key)
+	}
+
+	if c.baseURL == "" {
+		return raw
+	}
+
+	path := raw
+	if i := strings.Index(path, "://"); i >= 0 {
+		path = path[i+3:]
+	}
+	if i := strings.Index(path, "/"); i >= 0 {
+		path = path[i:]
+	} else {
+		path = ""
+	}
+
+	return strings.TrimRight(c.baseURL, "/") + path
+}
+
+func (c *httpCloud) Nodes() (map[string]Node, error) {
 	var data []Node
-	err := req(config.MustString("cloud", "nodes"), &data)
+	err := c.req("GET", fmt.Sprintf(c.url("nodes"), credsToken()), &data)
 	log.Debugf("Fetched nodes: %+v", data)
 
 	m := make(map[string]Node)
@@ -66,9 +153,9 @@ func getNodes() (map[string]Node, error) {
 	return m, err
 }
 
-func getSites() (map[string]Site, error) {
+func (c *httpCloud) Sites() (map[string]Site, error) {
 	var data []Site
-	err := req(config.MustString("cloud", "sites"), &data)
+	err := c.req("GET", fmt.Sprintf(c.url("sites"), credsToken()), &data)
 	log.Debugf("Fetched sites: %+v", data)
 
 	m := make(map[string]Site)
@@ -79,23 +166,26 @@ func getSites() (map[string]Site, error) {
 	return m, err
 }
 
-func req(url string, data interface{}) error {
-
-	client := &http.Client{
-		Timeout: time.Second * 30,
+func (c *httpCloud) Unpair(nodeID string) error {
+	if _, ok := c.urls["unpair"]; !ok && !config.HasString("cloud", "unpair") {
+		return errorUnpairUnsupported
 	}
 
-	if config.Bool(false, "cloud", "allowSelfSigned") {
-		log.Warningf("Allowing self-signed cerificate (should only be used to connect to development cloud)")
-		client.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
+	return c.req("DELETE", fmt.Sprintf(c.url("unpair"), nodeID, credsToken()), nil)
+}
+
+func (c *httpCloud) req(method, url string, data interface{}) error {
+
+	request, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return err
 	}
 
-	resp, err := client.Get(fmt.Sprintf(url, config.MustString("token")))
+	resp, err := c.rest.Do(request)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -124,5 +214,74 @@ func req(url string, data interface{}) error {
 		return fmt.Errorf("Error from cloud: %s (%s)", data.Message, data.Type)
 	}
 
+	if data == nil {
+		return nil
+	}
+
 	return json.Unmarshal(response.Data, data)
 }
+
+type nodeClaimResponse struct {
+	Type string `json:"type"`
+	Data struct {
+		UserID           string `json:"user_id"`
+		NodeID           string `json:"node_id"`
+		Token            string `json:"token"`
+		SphereNetworkKey string `json:"sphere_network_key"`
+	} `json:"data"`
+}
+
+func (c *httpCloud) Activate(nodeID, localIP, boardType string, cancel <-chan struct{}) (*Credentials, error) {
+
+	url := fmt.Sprintf(c.url("activation"), nodeID, localIP, boardType)
+
+	log.Debugf("Requesting url: %s", url)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Cancel = cancel
+
+	resp, err := c.activation.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusRequestTimeout {
+		return nil, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to activate: %s - %s", resp.Status, body)
+	}
+
+	log.Debugf("Got response: %s", body)
+
+	var response nodeClaimResponse
+	err = json.Unmarshal(body, &response)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal credentials from cloud: %s (%s)", body, err)
+	}
+
+	if response.Data.NodeID != nodeID {
+		return nil, fmt.Errorf("Incorrect node id returned from pairing! Expected %s got %s", nodeID, response.Data.NodeID)
+	}
+
+	if response.Data.UserID == "" || response.Data.Token == "" || response.Data.SphereNetworkKey == "" {
+		return nil, fmt.Errorf("Invalid credentials (missing value): %s", body)
+	}
+
+	return &Credentials{
+		UserID:           response.Data.UserID,
+		Token:            response.Data.Token,
+		SphereNetworkKey: response.Data.SphereNetworkKey,
+	}, nil
+}
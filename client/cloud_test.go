@@ -0,0 +1,282 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+// fakeCloud is an in-process stand-in for the parts of the REST api used by the client.
+type fakeCloud struct {
+	sync.Mutex
+	nodeID     string
+	token      string
+	siteID     string
+	masterID   string
+	claimedID  string
+	updated    time.Time
+	activation int
+	unpaired   []string
+}
+
+func newFakeCloud() *fakeCloud {
+	return &fakeCloud{
+		nodeID:   config.Serial(),
+		token:    "token-1",
+		siteID:   "site-1",
+		masterID: "master-1",
+		updated:  time.Unix(1400000000, 0).UTC(),
+	}
+}
+
+func (f *fakeCloud) reply(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"type": "object", "data": data})
+}
+
+func (f *fakeCloud) authorised(w http.ResponseWriter, r *http.Request) bool {
+	if r.FormValue("access_token") != f.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"type": "error",
+			"data": map[string]interface{}{"type": "authentication_invalid_token"},
+		})
+		return false
+	}
+	return true
+}
+
+func (f *fakeCloud) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	switch r.URL.Path {
+	case "/rest/v1/nodes/" + f.nodeID + "/activate":
+		f.activation++
+		if f.activation == 1 {
+			// The first request times out waiting for the user, like the real thing.
+			w.WriteHeader(http.StatusRequestTimeout)
+			return
+		}
+		claimedID := f.nodeID
+		if f.claimedID != "" {
+			claimedID = f.claimedID
+		}
+		f.reply(w, map[string]string{
+			"user_id":            "user-1",
+			"node_id":            claimedID,
+			"token":              f.token,
+			"sphere_network_key": "network-key",
+		})
+
+	case "/rest/v1/nodes":
+		if f.authorised(w, r) {
+			f.reply(w, []map[string]string{{"node_id": f.nodeID, "site_id": f.siteID}})
+		}
+
+	case "/rest/v1/sites":
+		if f.authorised(w, r) {
+			f.reply(w, []map[string]string{{
+				"site_id":        f.siteID,
+				"master_node_id": f.masterID,
+				"user_id":        "user-1",
+				"updated":        f.updated.Format(time.RFC3339),
+			}})
+		}
+
+	case "/rest/v1/nodes/" + f.nodeID:
+		if r.Method == "DELETE" && f.authorised(w, r) {
+			f.unpaired = append(f.unpaired, f.nodeID)
+			f.reply(w, nil)
+		}
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// withTempFiles points the files the client persists at a temp dir, until the returned func is
+// called.
+func withTempFiles(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "sphere-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldCreds, oldView, oldMesh, oldAppKeys := credsFile, credsViewFile, meshFile, appKeysFile
+	credsFile = filepath.Join(dir, "credentials.json")
+	credsViewFile = filepath.Join(dir, "run", "credentials.json")
+	meshFile = filepath.Join(dir, "mesh.json")
+	appKeysFile = filepath.Join(dir, "app-keys.json")
+	clearCredsCache()
+
+	return func() {
+		credsFile, credsViewFile, meshFile, appKeysFile = oldCreds, oldView, oldMesh, oldAppKeys
+		clearCredsCache()
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestCloud(t *testing.T, fake *fakeCloud) (CloudAPI, *httptest.Server) {
+	server := httptest.NewServer(fake)
+
+	// The configured urls point at the real cloud. The base url moves them onto the fake.
+	cloud, err := NewHTTPCloud(server.URL, nil)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+
+	cloud.(*httpCloud).urls = map[string]string{
+		"activation": "https://api.sphere.ninja/rest/v1/nodes/%s/activate?ip=%s&board=%s",
+		"nodes":      "https://api.sphere.ninja/rest/v1/nodes?access_token=%s",
+		"sites":      "https://api.sphere.ninja/rest/v1/sites?access_token=%s",
+		"unpair":     "https://api.sphere.ninja/rest/v1/nodes/%s?access_token=%s",
+	}
+
+	return cloud, server
+}
+
+func TestPairingAndMeshRefresh(t *testing.T) {
+	defer withTempFiles(t)()
+
+	fake := newFakeCloud()
+	cloud, server := newTestCloud(t, fake)
+	defer server.Close()
+
+	creds, err := cloud.Activate(fake.nodeID, "10.0.0.2", "test", nil)
+	if err != nil || creds != nil {
+		t.Fatalf("Expected the first activation to time out, got %+v, %v", creds, err)
+	}
+
+	creds, err = cloud.Activate(fake.nodeID, "10.0.0.2", "test", nil)
+	if err != nil {
+		t.Fatalf("Failed to activate: %s", err)
+	}
+
+	if creds.UserID != "user-1" || creds.Token != fake.token || creds.SphereNetworkKey != "network-key" {
+		t.Fatalf("Unexpected credentials: %+v", creds)
+	}
+
+	if err := saveCreds(creds); err != nil {
+		t.Fatalf("Failed to save credentials: %s", err)
+	}
+
+	mesh, err := refreshMeshInfo(cloud)
+	if err != nil {
+		t.Fatalf("Failed to refresh mesh info: %s", err)
+	}
+
+	if mesh.SiteID != fake.siteID || mesh.MasterNodeID != fake.masterID || mesh.SiteUpdated != int(fake.updated.Unix()) {
+		t.Fatalf("Unexpected mesh info: %+v", mesh)
+	}
+
+	data, err := loadFile(meshFile)
+	if err != nil {
+		t.Fatalf("Mesh info wasn't saved: %s", err)
+	}
+
+	var saved meshInfo
+	if err := json.Unmarshal(data, &saved); err != nil || saved != *mesh {
+		t.Fatalf("Saved mesh info %s doesn't match %+v", data, mesh)
+	}
+
+	if err := cloud.Unpair(fake.nodeID); err != nil {
+		t.Fatalf("Failed to unpair: %s", err)
+	}
+
+	if len(fake.unpaired) != 1 {
+		t.Fatalf("Expected the node to be unpaired, got %v", fake.unpaired)
+	}
+}
+
+func TestActivateRejectsOtherNode(t *testing.T) {
+	fake := newFakeCloud()
+	fake.activation = 1
+	fake.claimedID = "someone-else"
+	cloud, server := newTestCloud(t, fake)
+	defer server.Close()
+
+	if creds, err := cloud.Activate(fake.nodeID, "10.0.0.2", "test", nil); err == nil {
+		t.Fatalf("Expected an error, got %+v", creds)
+	}
+}
+
+func TestUnauthorisedToken(t *testing.T) {
+	defer withTempFiles(t)()
+
+	fake := newFakeCloud()
+	cloud, server := newTestCloud(t, fake)
+	defer server.Close()
+
+	if err := saveCreds(&Credentials{UserID: "user-1", Token: "expired"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := refreshMeshInfo(cloud); err != errorUnauthorised {
+		t.Fatalf("Expected %s, got %v", errorUnauthorised, err)
+	}
+}
+
+func TestCloudURLRebasing(t *testing.T) {
+	c := &httpCloud{
+		baseURL: "http://127.0.0.1:1234/",
+		urls:    map[string]string{"nodes": "https://api.sphere.ninja/rest/v1/nodes?access_token=%s"},
+	}
+
+	if url := fmt.Sprintf(c.url("nodes"), "t"); url != "http://127.0.0.1:1234/rest/v1/nodes?access_token=t" {
+		t.Fatalf("Unexpected url: %s", url)
+	}
+}
+
+func TestMeshRefreshKeepsElectedMaster(t *testing.T) {
+	defer withTempFiles(t)()
+
+	fake := newFakeCloud()
+	cloud, server := newTestCloud(t, fake)
+	defer server.Close()
+
+	if err := saveCreds(&Credentials{UserID: "user-1", Token: fake.token}); err != nil {
+		t.Fatal(err)
+	}
+
+	elected := &meshInfo{
+		SiteID:       fake.siteID,
+		MasterNodeID: "elected-1",
+		SiteUpdated:  int(fake.updated.Unix()),
+		ElectedFrom:  fake.masterID,
+	}
+	if err := saveMeshInfo(elected); err != nil {
+		t.Fatal(err)
+	}
+
+	mesh, err := refreshMeshInfo(cloud)
+	if err != nil {
+		t.Fatalf("Failed to refresh mesh info: %s", err)
+	}
+	if *mesh != *elected {
+		t.Fatalf("Expected the elected master to be kept, got %+v", mesh)
+	}
+
+	// Once the site changes in the cloud, its master wins.
+	fake.Lock()
+	fake.updated = fake.updated.Add(time.Hour)
+	fake.Unlock()
+
+	mesh, err = refreshMeshInfo(cloud)
+	if err != nil {
+		t.Fatalf("Failed to refresh mesh info: %s", err)
+	}
+	if mesh.MasterNodeID != fake.masterID || mesh.ElectedFrom != "" {
+		t.Fatalf("Expected the cloud's master, got %+v", mesh)
+	}
+}
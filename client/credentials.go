@@ -0,0 +1,348 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+var credsFile = config.String("/data/etc/opt/ninja/credentials.json", "credentialFile")
+
+// If set, the token and sphere network key are encrypted on disk with a key derived from a hardware
+// secret (client.credentials.secretFile). The serial is in our mDNS records, so it is no secret, and
+// without a hardware secret the credentials are left in the clear.
+//
+// While encrypted, the decrypted credentials are kept in client.credentials.viewFile (which should
+// be on tmpfs, and in go-ninja's config path) so the other processes on the box can still read the
+// token through their config.
+var encryptCreds = config.Bool(false, "client", "credentials", "encrypt")
+var credsSecretFile = config.String("", "client", "credentials", "secretFile")
+var credsViewFile = config.String("/var/run/ninja/credentials.json", "client", "credentials", "viewFile")
+
+var credsSecretWarning sync.Once
+
+// credsEncrypted returns whether credentials should be encrypted on disk.
+func credsEncrypted() bool {
+	if encryptCreds && credsSecretFile == "" {
+		credsSecretWarning.Do(func() {
+			log.Warningf("Not encrypting credentials, as there is no hardware secret (client.credentials.secretFile)")
+		})
+		return false
+	}
+	return encryptCreds
+}
+
+// credsCache holds the credentials once they have been loaded, so they are only read (and migrated)
+// once.
+var credsCache struct {
+	sync.Mutex
+	creds *Credentials
+}
+
+// credentialsVersion is the current schema version of credentials.json. Files written before the
+// version field existed are version 0.
+const credentialsVersion = 2
+
+// Credentials are what a node is given when it is paired, and are kept in credentials.json.
+type Credentials struct {
+	Version          int    `json:"version,omitempty"`
+	UserID           string `json:"userId"`
+	Token            string `json:"token,omitempty"`
+	SphereNetworkKey string `json:"sphereNetworkKey,omitempty"`
+	// Local is set if we were paired by joining a master on the LAN, rather than through the
+	// cloud, so have no token.
+	Local     bool   `json:"local,omitempty"`
+	Encrypted bool   `json:"encrypted,omitempty"`
+	Nonce     []byte `json:"nonce,omitempty"`
+	Data      []byte `json:"data,omitempty"`
+}
+
+// encryptedSecrets is the plaintext of Credentials.Data
+type encryptedSecrets struct {
+	Token            string `json:"token"`
+	SphereNetworkKey string `json:"sphereNetworkKey"`
+}
+
+// saveCreds writes the credentials atomically with mode 0600, encrypting them if enabled.
+func saveCreds(creds *Credentials) error {
+	credsCache.Lock()
+	defer credsCache.Unlock()
+
+	if err := writeCreds(creds); err != nil {
+		return err
+	}
+
+	cached := *creds
+	credsCache.creds = &cached
+	return nil
+}
+
+func writeCreds(creds *Credentials) error {
+
+	log.Infof("Saving credentials to %s", credsFile)
+
+	stored := &Credentials{
+		Version: credentialsVersion,
+		UserID:  creds.UserID,
+		Local:   creds.Local,
+	}
+
+	encrypt := credsEncrypted()
+
+	if encrypt {
+		secrets, err := json.Marshal(encryptedSecrets{creds.Token, creds.SphereNetworkKey})
+		if err != nil {
+			return fmt.Errorf("Failed to marshal credentials: %s", err)
+		}
+
+		stored.Encrypted = true
+		stored.Nonce, stored.Data, err = sealCreds(secrets)
+		if err != nil {
+			return fmt.Errorf("Failed to encrypt credentials: %s", err)
+		}
+	} else {
+		stored.Token = creds.Token
+		stored.SphereNetworkKey = creds.SphereNetworkKey
+	}
+
+	credsJSON, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal credentials: %s", err)
+	}
+
+	if err := saveFile(credsFile, credsJSON, 0600); err != nil {
+		return fmt.Errorf("Failed to write credentials file: %s", err)
+	}
+
+	if encrypt {
+		return writeCredsView(creds)
+	}
+
+	if err := os.Remove(credsViewFile); err != nil && !os.IsNotExist(err) {
+		log.Warningf("Failed to remove decrypted credentials %s: %s", credsViewFile, err)
+	}
+
+	return nil
+}
+
+// writeCredsView writes the decrypted credentials where the other processes on the box can read
+// them.
+func writeCredsView(creds *Credentials) error {
+
+	view, err := json.Marshal(&Credentials{
+		Version:          credentialsVersion,
+		UserID:           creds.UserID,
+		Token:            creds.Token,
+		SphereNetworkKey: creds.SphereNetworkKey,
+		Local:            creds.Local,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to marshal credentials: %s", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(credsViewFile), 0755); err != nil {
+		return fmt.Errorf("Failed to create %s: %s", filepath.Dir(credsViewFile), err)
+	}
+
+	if err := writeFileAtomic(credsViewFile, view, 0600); err != nil {
+		return fmt.Errorf("Failed to write decrypted credentials: %s", err)
+	}
+
+	return nil
+}
+
+// loadCreds returns the credentials, reading them the first time it is called.
+func loadCreds() (*Credentials, error) {
+	credsCache.Lock()
+	defer credsCache.Unlock()
+
+	if credsCache.creds == nil {
+		creds, err := readCreds()
+		if err != nil {
+			return nil, err
+		}
+		credsCache.creds = creds
+	}
+
+	creds := *credsCache.creds
+	return &creds, nil
+}
+
+// clearCredsCache makes the next loadCreds read the credentials file again.
+func clearCredsCache() {
+	credsCache.Lock()
+	credsCache.creds = nil
+	credsCache.Unlock()
+}
+
+// readCreds reads the credentials file, decrypting it if needed. Files in an older format (or
+// that aren't encrypted when they should be) are migrated to the current one.
+func readCreds() (*Credentials, error) {
+
+	data, err := loadFile(credsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored Credentials
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("Failed to parse credentials file %s: %s", credsFile, err)
+	}
+
+	creds := &Credentials{
+		UserID:           stored.UserID,
+		Token:            stored.Token,
+		SphereNetworkKey: stored.SphereNetworkKey,
+		Local:            stored.Local,
+	}
+
+	if stored.Encrypted {
+		plain, err := openCreds(stored.Nonce, stored.Data)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decrypt credentials: %s", err)
+		}
+
+		var secrets encryptedSecrets
+		if err := json.Unmarshal(plain, &secrets); err != nil {
+			return nil, fmt.Errorf("Failed to parse decrypted credentials: %s", err)
+		}
+
+		creds.Token = secrets.Token
+		creds.SphereNetworkKey = secrets.SphereNetworkKey
+	}
+
+	encrypt := credsEncrypted()
+
+	if stored.Version < credentialsVersion || stored.Encrypted != encrypt {
+		log.Infof("Migrating credentials from version %d (encrypted:%t) to version %d (encrypted:%t)", stored.Version, stored.Encrypted, credentialsVersion, encrypt)
+		if err := writeCreds(creds); err != nil {
+			log.Warningf("Failed to migrate credentials: %s", err)
+		}
+	} else if stored.Encrypted {
+		// The view is on tmpfs, so is gone after a reboot.
+		if err := writeCredsView(creds); err != nil {
+			log.Warningf("%s", err)
+		}
+	}
+
+	return creds, nil
+}
+
+// deleteCreds removes the credentials (and their backup), e.g. when we are unpaired.
+func deleteCreds() error {
+	credsCache.Lock()
+	defer credsCache.Unlock()
+
+	credsCache.creds = nil
+
+	if err := os.Remove(credsViewFile); err != nil && !os.IsNotExist(err) {
+		log.Warningf("Failed to remove decrypted credentials %s: %s", credsViewFile, err)
+	}
+
+	if err := removeFile(credsFile); err != nil {
+		return fmt.Errorf("Failed to delete credentials: %s", err)
+	}
+
+	return nil
+}
+
+// locallyPaired returns true if we were paired by joining a master on the LAN.
+func locallyPaired() bool {
+	creds, err := loadCreds()
+	return err == nil && creds.Local && creds.UserID != ""
+}
+
+// isPaired returns true if we have been paired, either through the cloud or locally. It goes by the
+// credentials file rather than the config, as while they are encrypted the config only sees the
+// token once loadCreds has written the view.
+func isPaired() bool {
+	creds, err := loadCreds()
+	if err != nil {
+		return config.IsPaired()
+	}
+	return creds.UserID != "" && (creds.Token != "" || creds.Local)
+}
+
+// credsToken returns the cloud token.
+func credsToken() string {
+	creds, err := loadCreds()
+	if err != nil {
+		log.Warningf("Failed to load credentials, falling back to config: %s", err)
+		return config.MustString("token")
+	}
+	return creds.Token
+}
+
+// credsKey derives the credentials encryption key from the hardware secret.
+func credsKey() ([]byte, error) {
+	if credsSecretFile == "" {
+		return nil, errors.New("No hardware secret configured")
+	}
+
+	secret, err := ioutil.ReadFile(credsSecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read hardware secret: %s", err)
+	}
+
+	secret = []byte(strings.TrimSpace(string(secret)))
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("Hardware secret %s is empty", credsSecretFile)
+	}
+
+	key := hmac.New(sha256.New, secret)
+	key.Write([]byte("credentials|" + config.Serial()))
+	return key.Sum(nil), nil
+}
+
+func credsCipher() (cipher.AEAD, error) {
+	key, err := credsKey()
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func sealCreds(plain []byte) (nonce, data []byte, err error) {
+	aead, err := credsCipher()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+
+	return nonce, aead.Seal(nil, nonce, plain, []byte(config.Serial())), nil
+}
+
+func openCreds(nonce, data []byte) ([]byte, error) {
+	aead, err := credsCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("Invalid nonce")
+	}
+
+	return aead.Open(nil, nonce, data, []byte(config.Serial()))
+}
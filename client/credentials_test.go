@@ -0,0 +1,138 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func withEncryption(secretFile string) func() {
+	oldEncrypt, oldSecret := encryptCreds, credsSecretFile
+	encryptCreds, credsSecretFile = true, secretFile
+	return func() {
+		encryptCreds, credsSecretFile = oldEncrypt, oldSecret
+	}
+}
+
+func TestEncryptedCredentials(t *testing.T) {
+	defer withTempFiles(t)()
+
+	secretFile := filepath.Join(filepath.Dir(credsFile), "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("hardware-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer withEncryption(secretFile)()
+
+	creds := &Credentials{UserID: "user-1", Token: "token-1", SphereNetworkKey: "network-key"}
+	if err := saveCreds(creds); err != nil {
+		t.Fatalf("Failed to save credentials: %s", err)
+	}
+
+	stored, err := ioutil.ReadFile(credsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(stored), "token-1") || strings.Contains(string(stored), "network-key") {
+		t.Fatalf("Secrets were saved in the clear: %s", stored)
+	}
+
+	view, err := ioutil.ReadFile(credsViewFile)
+	if err != nil {
+		t.Fatalf("Decrypted credentials weren't written for other processes: %s", err)
+	}
+
+	var viewed Credentials
+	if err := json.Unmarshal(view, &viewed); err != nil || viewed.Token != "token-1" {
+		t.Fatalf("Unexpected decrypted credentials: %s", view)
+	}
+
+	clearCredsCache()
+
+	loaded, err := loadCreds()
+	if err != nil {
+		t.Fatalf("Failed to load credentials: %s", err)
+	}
+	if loaded.Token != "token-1" || loaded.SphereNetworkKey != "network-key" {
+		t.Fatalf("Unexpected credentials: %+v", loaded)
+	}
+}
+
+func TestEncryptedCredentialsAfterReboot(t *testing.T) {
+	defer withTempFiles(t)()
+
+	secretFile := filepath.Join(filepath.Dir(credsFile), "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("hardware-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer withEncryption(secretFile)()
+
+	if err := saveCreds(&Credentials{UserID: "user-1", Token: "token-1"}); err != nil {
+		t.Fatalf("Failed to save credentials: %s", err)
+	}
+
+	// The view is on tmpfs, so a reboot loses it (and the cache).
+	if err := os.Remove(credsViewFile); err != nil {
+		t.Fatal(err)
+	}
+	clearCredsCache()
+
+	if !isPaired() {
+		t.Fatalf("Expected to still be paired after the decrypted credentials were lost")
+	}
+
+	view, err := ioutil.ReadFile(credsViewFile)
+	if err != nil {
+		t.Fatalf("Decrypted credentials weren't written again: %s", err)
+	}
+
+	var viewed Credentials
+	if err := json.Unmarshal(view, &viewed); err != nil || viewed.Token != "token-1" {
+		t.Fatalf("Unexpected decrypted credentials: %s", view)
+	}
+}
+
+func TestEncryptionRequiresSecret(t *testing.T) {
+	defer withTempFiles(t)()
+	defer withEncryption("")()
+
+	if err := saveCreds(&Credentials{UserID: "user-1", Token: "token-1"}); err != nil {
+		t.Fatalf("Failed to save credentials: %s", err)
+	}
+
+	stored, err := ioutil.ReadFile(credsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var creds Credentials
+	if err := json.Unmarshal(stored, &creds); err != nil || creds.Encrypted || creds.Token != "token-1" {
+		t.Fatalf("Expected plaintext credentials without a hardware secret, got %s", stored)
+	}
+}
+
+func TestCredentialsMigration(t *testing.T) {
+	defer withTempFiles(t)()
+
+	// The original format, with no version
+	if err := ioutil.WriteFile(credsFile, []byte(`{"userId":"user-1","token":"token-1","sphereNetworkKey":"network-key"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	creds, err := loadCreds()
+	if err != nil || creds.Token != "token-1" {
+		t.Fatalf("Failed to load old credentials: %+v %v", creds, err)
+	}
+
+	stored, err := ioutil.ReadFile(credsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var migrated Credentials
+	if err := json.Unmarshal(stored, &migrated); err != nil || migrated.Version != credentialsVersion {
+		t.Fatalf("Credentials weren't migrated: %s", stored)
+	}
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+// If the master hasn't been seen for the grace period, the orphaned slaves elect a new one from
+// the siblings they can see. When the original master comes back, mastership is handed back to it.
+var electionEnabled = config.Bool(true, "client", "election", "enabled")
+var electionGracePeriod = config.Duration(time.Minute*2, "client", "election", "gracePeriod")
+
+// Peers not seen for this long aren't considered in an election.
+var electionPeerTimeout = config.Duration(time.Second*90, "client", "election", "peerTimeout")
+
+// runElections periodically checks whether we have been orphaned long enough to elect a new master.
+func (c *client) runElections() {
+	for range time.Tick(time.Second * 10) {
+		if !electionEnabled || !c.state.is(stateOrphaned) {
+			continue
+		}
+
+		lastHeard := c.peers.lastSeen(config.MustString("masterNodeId"))
+
+		c.mu.Lock()
+		if c.lastMasterMessage.After(lastHeard) {
+			lastHeard = c.lastMasterMessage
+		}
+		c.mu.Unlock()
+
+		if time.Since(lastHeard) < electionGracePeriod {
+			continue
+		}
+
+		current := config.MustString("masterNodeId")
+		winner := c.electMaster(current)
+
+		if winner == "" || winner == current {
+			continue
+		}
+
+		electedFrom := config.String(current, "electedFrom")
+
+		log.Infof("Master %s hasn't been seen for %s. Elected %s in its place.", current, time.Since(lastHeard), winner)
+
+		err := saveMeshInfo(&meshInfo{
+			SiteID:       config.MustString("siteId"),
+			MasterNodeID: winner,
+			SiteUpdated:  config.MustInt("siteUpdated"),
+			ElectedFrom:  electedFrom,
+		})
+		if err != nil {
+			log.Warningf("Failed to save elected master: %s", err)
+			continue
+		}
+
+		c.switchMaster(winner)
+	}
+}
+
+// electMaster picks a new master from ourselves and the siblings seen recently, excluding the
+// current (missing) master. If any siblings have already elected a master that is still around we
+// go along with it, otherwise the lowest node id wins.
+func (c *client) electMaster(current string) string {
+
+	fresh := func(id string) bool {
+		return id == config.Serial() || c.peers.fresh(id, electionPeerTimeout)
+	}
+
+	candidates := []string{config.Serial()}
+	var elected []string
+
+	for _, peer := range c.peers.list() {
+		if peer.ID == current || !fresh(peer.ID) {
+			continue
+		}
+
+		if peer.UserID != config.MustString("userId") || peer.SiteID != config.MustString("siteId") {
+			continue
+		}
+
+		candidates = append(candidates, peer.ID)
+
+		if peer.MasterNodeID != "" && peer.MasterNodeID != current && fresh(peer.MasterNodeID) {
+			elected = append(elected, peer.MasterNodeID)
+		}
+	}
+
+	if len(elected) > 0 {
+		sort.Strings(elected)
+		return elected[0]
+	}
+
+	sort.Strings(candidates)
+	return candidates[0]
+}
+
+// checkHandback hands mastership back to the original master if it has returned (and still
+// thinks it is the master).
+func (c *client) checkHandback(peer *peerInfo) {
+
+	electedFrom := config.String("", "electedFrom")
+
+	if electedFrom == "" || peer.ID != electedFrom || peer.MasterNodeID != electedFrom {
+		return
+	}
+
+	if peer.UserID != config.MustString("userId") || peer.SiteID != config.MustString("siteId") {
+		return
+	}
+
+	log.Infof("The original master (%s) is back. Handing mastership back to it.", electedFrom)
+
+	err := saveMeshInfo(&meshInfo{
+		SiteID:       config.MustString("siteId"),
+		MasterNodeID: electedFrom,
+		SiteUpdated:  config.MustInt("siteUpdated"),
+	})
+	if err != nil {
+		log.Warningf("Failed to save mesh info when handing back mastership: %s", err)
+		return
+	}
+
+	c.switchMaster(electedFrom)
+}
@@ -0,0 +1,75 @@
+package client
+
+import "github.com/ninjasphere/go-ninja/config"
+
+// switchMaster moves us over to a new master, once it has been saved to the mesh info. We step
+// down to paired, then take up our new role as either the master or one of its slaves, without
+// rebooting.
+func (c *client) switchMaster(masterNodeID string) {
+	c.switching.Lock()
+	defer c.switching.Unlock()
+
+	config.MustRefresh()
+
+	if !c.state.is(stateMaster, stateSlaveSearching, stateSlaveBridged, stateOrphaned) {
+		log.Infof("Not switching to master %s, as we haven't taken up a role yet. State: %s", masterNodeID, c.state.current())
+		return
+	}
+
+	if c.state.is(stateMaster) && masterNodeID == config.Serial() {
+		return
+	}
+
+	log.Infof("Switching to master %s", masterNodeID)
+
+	c.setState(statePaired)
+
+	if masterNodeID == config.Serial() {
+		c.setState(stateMaster)
+	} else {
+		c.setState(stateSlaveSearching)
+
+		// Once we have stepped down, so the old bridge isn't torn down after the new one is up.
+		go func() {
+			c.state.wait()
+			c.findPeers()
+		}()
+	}
+}
+
+// stepDown tears down what was set up for our previous role, called when we move back to paired.
+func (c *client) stepDown(from clientState) {
+
+	log.Infof("Stepping down from %s", from)
+
+	switch from {
+	case stateMaster:
+		c.stopMasterServices()
+
+		c.stopService(homeCloudService)
+
+	case stateOrphaned:
+		c.enableLEDControl()
+		c.unbridge()
+
+	default:
+		c.unbridge()
+	}
+}
+
+// stopMasterServices stops accepting join requests (dropping any pending) and bridge auth
+// challenges.
+func (c *client) stopMasterServices() {
+	c.mu.Lock()
+	listener, subscriptions := c.pairingListener, c.masterSubscriptions
+	c.pairingListener, c.joins, c.masterSubscriptions = nil, nil, nil
+	c.mu.Unlock()
+
+	for _, sub := range subscriptions {
+		sub.Cancel()
+	}
+
+	if listener != nil {
+		listener.Close()
+	}
+}
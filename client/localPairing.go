@@ -0,0 +1,557 @@
+package client
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+// Local pairing lets an unpaired node join an existing master's site over the LAN, without the
+// cloud. The joining node and the master agree a key using ECDH, and both show a confirmation code
+// derived from it. The code is only shown on the joining node. The request is approved by entering
+// that code on the master through its status api (see approveJoin), which only HomeCloud (on behalf
+// of the user's app session) and local tooling have the token for. The master then sends the user,
+// site and sphere network key encrypted with the agreed key.
+//
+// Off by default, except without a cloud. Both the master and the joining node must enable it.
+var localPairingEnabled = config.Bool(false, "client", "pairing", "enabled")
+var localPairingPort = config.Int(8889, "client", "pairing", "port")
+var localPairingApprovalTimeout = config.Duration(time.Minute*2, "client", "pairing", "approvalTimeout")
+
+// Only for development. Every join request is approved without waiting for confirmation.
+var localPairingAutoApprove = config.Bool(false, "client", "pairing", "autoApprove")
+
+var localPairingRetry = loadRetryPolicy("localPairing", retryPolicy{
+	Initial:    time.Second * 5,
+	Max:        time.Minute,
+	Multiplier: 2,
+	Jitter:     0.3,
+})
+
+// A join request is denied after this many wrong codes.
+const maxJoinCodeAttempts = 3
+
+var errJoinDenied = errors.New("Join request was denied by the master")
+var errPairingCancelled = errors.New("Pairing cancelled")
+var errNoPendingJoin = errors.New("No pending join request from that node")
+var errWrongJoinCode = errors.New("Wrong confirmation code")
+
+type joinRequest struct {
+	NodeID    string `json:"nodeId"`
+	PublicKey []byte `json:"publicKey,omitempty"`
+}
+
+type joinResponse struct {
+	PublicKey []byte `json:"publicKey,omitempty"`
+	Nonce     []byte `json:"nonce,omitempty"`
+	Data      []byte `json:"data,omitempty"`
+}
+
+// joinGrant is the encrypted content of a joinResponse.
+type joinGrant struct {
+	UserID           string `json:"userId"`
+	SiteID           string `json:"siteId"`
+	SiteUpdated      int    `json:"siteUpdated"`
+	MasterNodeID     string `json:"masterNodeId"`
+	SphereNetworkKey string `json:"sphereNetworkKey"`
+}
+
+// joinPending is published on $node/<master>/client/join/request when a node asks to join, so the
+// app can ask the user for the code shown on it. It doesn't include the code.
+type joinPending struct {
+	NodeID  string `json:"nodeId"`
+	Address string `json:"address"`
+}
+
+// joinKeys derives the encryption key and the confirmation code from the ECDH shared secret.
+func joinKeys(priv []byte, peerPublic, masterPublic, joinerPublic []byte) (key []byte, code string, err error) {
+
+	curve := elliptic.P256()
+
+	x, y := elliptic.Unmarshal(curve, peerPublic)
+	if x == nil {
+		return nil, "", errors.New("Invalid public key")
+	}
+
+	shared, _ := curve.ScalarMult(x, y, priv)
+
+	h := sha256.New()
+	h.Write(shared.Bytes())
+	h.Write(masterPublic)
+	h.Write(joinerPublic)
+	key = h.Sum(nil)
+
+	c := sha256.Sum256(append([]byte("confirmation code"), key...))
+	code = fmt.Sprintf("%06d", binary.BigEndian.Uint32(c[:4])%1000000)
+
+	return key, code, nil
+}
+
+func joinCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// localPairingAllowed returns whether we accept (as the master) or make join requests. A node with
+// no cloud can't be paired any other way, so always does.
+func localPairingAllowed() bool {
+	return localPairingEnabled || config.NoCloud()
+}
+
+// pendingJoin is a join request waiting for approval on the master.
+type pendingJoin struct {
+	key      []byte
+	code     string
+	attempts int
+	approved chan bool
+	expires  time.Time
+}
+
+// pendingJoins are the join requests waiting for approval on the master, by node id.
+type pendingJoins struct {
+	sync.Mutex
+	joins map[string]*pendingJoin
+}
+
+func newPendingJoins() *pendingJoins {
+	return &pendingJoins{joins: make(map[string]*pendingJoin)}
+}
+
+// get returns a node's pending join. It also drops any expired ones, so nodes that never come back
+// for approval don't pile up.
+func (p *pendingJoins) get(nodeID string) *pendingJoin {
+	p.Lock()
+	defer p.Unlock()
+
+	for id, join := range p.joins {
+		if time.Now().After(join.expires) {
+			delete(p.joins, id)
+		}
+	}
+	return p.joins[nodeID]
+}
+
+func (p *pendingJoins) add(nodeID string, join *pendingJoin) {
+	p.Lock()
+	p.joins[nodeID] = join
+	p.Unlock()
+}
+
+func (p *pendingJoins) remove(nodeID string) {
+	p.Lock()
+	delete(p.joins, nodeID)
+	p.Unlock()
+}
+
+// approve approves a node's pending join if code is the one shown on it, or denies it. After
+// maxJoinCodeAttempts wrong codes the request is denied, and errJoinDenied returned.
+func (p *pendingJoins) approve(nodeID, code string, approved bool) error {
+	join := p.get(nodeID)
+	if join == nil {
+		return errNoPendingJoin
+	}
+
+	var err error
+
+	if approved {
+		p.Lock()
+		if subtle.ConstantTimeCompare([]byte(code), []byte(join.code)) != 1 {
+			join.attempts++
+			err = errWrongJoinCode
+		}
+		attempts := join.attempts
+		p.Unlock()
+
+		if err != nil && attempts < maxJoinCodeAttempts {
+			return err
+		}
+
+		if err != nil {
+			log.Warningf("Denying join request from %s after %d wrong codes", nodeID, attempts)
+			approved, err = false, errJoinDenied
+		}
+	}
+
+	select {
+	case join.approved <- approved:
+	default:
+	}
+
+	return err
+}
+
+// approveJoin approves (or denies) a node's request to join our site. Approving needs the code
+// shown on the joining node.
+func (c *client) approveJoin(nodeID, code string, approved bool) error {
+	c.mu.Lock()
+	joins := c.joins
+	c.mu.Unlock()
+
+	if joins == nil {
+		return errNoPendingJoin
+	}
+
+	return joins.approve(nodeID, code, approved)
+}
+
+// startPairingServer accepts join requests from unpaired nodes. Only run on the master.
+//
+// A joining node first POSTs its public key to /join, getting ours in return, so both sides can
+// show the confirmation code. It then POSTs to /join/wait, which returns the encrypted grant once
+// the request has been approved.
+func (c *client) startPairingServer() {
+
+	if !localPairingAllowed() {
+		return
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", localPairingPort))
+	if err != nil {
+		log.Warningf("Failed to start local pairing on port %d: %s", localPairingPort, err)
+		return
+	}
+
+	pending := newPendingJoins()
+
+	c.mu.Lock()
+	c.pairingListener = listener
+	c.joins = pending
+	c.mu.Unlock()
+
+	readRequest := func(w http.ResponseWriter, r *http.Request) *joinRequest {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return nil
+		}
+
+		var req joinRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NodeID == "" {
+			http.Error(w, "Invalid join request", http.StatusBadRequest)
+			return nil
+		}
+		return &req
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/join", func(w http.ResponseWriter, r *http.Request) {
+		req := readRequest(w, r)
+		if req == nil {
+			return
+		}
+
+		if pending.get(req.NodeID) != nil {
+			http.Error(w, "Join request already pending", http.StatusConflict)
+			return
+		}
+
+		priv, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			http.Error(w, "Failed to generate key", http.StatusInternalServerError)
+			return
+		}
+		public := elliptic.Marshal(elliptic.P256(), x, y)
+
+		key, code, err := joinKeys(priv, req.PublicKey, public, req.PublicKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		pending.add(req.NodeID, &pendingJoin{
+			key:      key,
+			code:     code,
+			approved: make(chan bool, 1),
+			expires:  time.Now().Add(localPairingApprovalTimeout),
+		})
+
+		log.Infof("Node %s (%s) is asking to join. Waiting for the code shown on it to be entered.", req.NodeID, r.RemoteAddr)
+
+		c.conn.SendNotification(fmt.Sprintf("$node/%s/client/join/request", config.Serial()), joinPending{
+			NodeID:  req.NodeID,
+			Address: r.RemoteAddr,
+		})
+		c.updatePairingLight("blue", true)
+
+		writeJSON(w, &joinResponse{PublicKey: public})
+	})
+
+	mux.HandleFunc("/join/wait", func(w http.ResponseWriter, r *http.Request) {
+		req := readRequest(w, r)
+		if req == nil {
+			return
+		}
+
+		join := pending.get(req.NodeID)
+		if join == nil {
+			http.Error(w, "No pending join request", http.StatusNotFound)
+			return
+		}
+
+		resp, err := c.waitForJoinApproval(req.NodeID, join)
+
+		if err != errRetryNow {
+			pending.remove(req.NodeID)
+			c.updatePairingLight("green", false)
+		}
+
+		switch {
+		case err == errJoinDenied:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case err == errRetryNow:
+			http.Error(w, "Timed out waiting for approval", http.StatusRequestTimeout)
+		case err != nil:
+			log.Warningf("Failed to handle join request from %s: %s", req.NodeID, err)
+			http.Error(w, "Failed to handle join request", http.StatusInternalServerError)
+		default:
+			writeJSON(w, resp)
+		}
+	})
+
+	log.Infof("Accepting local join requests on port %d", localPairingPort)
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Warningf("Local pairing stopped: %s", err)
+		}
+	}()
+}
+
+// waitForJoinApproval waits for a join request to be approved, and returns our credentials
+// encrypted for the joining node.
+func (c *client) waitForJoinApproval(nodeID string, join *pendingJoin) (*joinResponse, error) {
+
+	if !localPairingAutoApprove {
+		select {
+		case ok := <-join.approved:
+			if !ok {
+				log.Infof("Join request from %s was denied", nodeID)
+				return nil, errJoinDenied
+			}
+		case <-time.After(join.expires.Sub(time.Now())):
+			log.Infof("Join request from %s timed out", nodeID)
+			return nil, errJoinDenied
+		case <-time.After(time.Second * 30):
+			return nil, errRetryNow
+		}
+	}
+
+	creds, err := loadCreds()
+	if err != nil {
+		return nil, err
+	}
+
+	grant, err := json.Marshal(joinGrant{
+		UserID:           creds.UserID,
+		SiteID:           config.MustString("siteId"),
+		SiteUpdated:      config.Int(0, "siteUpdated"),
+		MasterNodeID:     config.Serial(),
+		SphereNetworkKey: creds.SphereNetworkKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := joinCipher(join.key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	log.Infof("Node %s has been approved to join site %s", nodeID, config.MustString("siteId"))
+
+	return &joinResponse{
+		Nonce: nonce,
+		Data:  aead.Seal(nil, nonce, grant, []byte(nodeID)),
+	}, nil
+}
+
+// postJoin posts a join request to the master, returning the parsed response.
+func postJoin(client *http.Client, url string, req *joinRequest) (*joinResponse, error) {
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusForbidden:
+		return nil, errJoinDenied
+	case http.StatusRequestTimeout:
+		return nil, errRetryNow
+	default:
+		return nil, fmt.Errorf("Failed to join: %s - %s", resp.Status, data)
+	}
+
+	var response joinResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("Failed to parse join response: %s", err)
+	}
+
+	return &response, nil
+}
+
+// requestJoin asks a master to let us join its site, waiting for the request to be approved or
+// done to be closed.
+func (c *client) requestJoin(master *advertisedMaster, done <-chan struct{}) (*joinGrant, error) {
+
+	priv, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	public := elliptic.Marshal(elliptic.P256(), x, y)
+
+	baseURL := fmt.Sprintf("http://%s:%d", master.Entry.Addr, master.PairingPort)
+
+	log.Infof("Asking master %s to join its site at %s", master.ID, baseURL)
+
+	client := &http.Client{
+		Timeout: time.Minute,
+	}
+
+	response, err := postJoin(client, baseURL+"/join", &joinRequest{
+		NodeID:    config.Serial(),
+		PublicKey: public,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	key, code, err := joinKeys(priv, response.PublicKey, response.PublicKey, public)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Waiting for the join request to be approved on master %s. Confirmation code: %s", master.ID, code)
+	c.conn.PublishRaw(fmt.Sprintf("$node/%s/client/join/code", config.Serial()), map[string]string{
+		"master": master.ID,
+		"code":   code,
+	})
+
+	for {
+		select {
+		case <-done:
+			return nil, errPairingCancelled
+		default:
+		}
+
+		response, err = postJoin(client, baseURL+"/join/wait", &joinRequest{NodeID: config.Serial()})
+		if err != errRetryNow {
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := joinCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(response.Nonce) != aead.NonceSize() {
+		return nil, errors.New("Invalid nonce in join response")
+	}
+
+	plain, err := aead.Open(nil, response.Nonce, response.Data, []byte(config.Serial()))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt join response: %s", err)
+	}
+
+	var grant joinGrant
+	if err := json.Unmarshal(plain, &grant); err != nil {
+		return nil, fmt.Errorf("Failed to parse join grant: %s", err)
+	}
+
+	if grant.MasterNodeID != master.ID || grant.UserID == "" || grant.SiteID == "" || grant.SphereNetworkKey == "" {
+		return nil, fmt.Errorf("Invalid join grant from master %s", master.ID)
+	}
+
+	return &grant, nil
+}
+
+// saveJoinGrant saves the credentials and mesh info handed over by the master.
+func saveJoinGrant(grant *joinGrant) error {
+
+	err := saveCreds(&Credentials{
+		UserID:           grant.UserID,
+		SphereNetworkKey: grant.SphereNetworkKey,
+		Local:            true,
+	})
+	if err != nil {
+		return err
+	}
+
+	return saveMeshInfo(&meshInfo{
+		SiteID:       grant.SiteID,
+		MasterNodeID: grant.MasterNodeID,
+		SiteUpdated:  grant.SiteUpdated,
+	})
+}
+
+// pairLocally looks for a master accepting join requests, and asks to join it, until we are
+// approved or done is closed.
+func (c *client) pairLocally(done <-chan struct{}) (*joinGrant, error) {
+
+	var grant *joinGrant
+
+	err := c.retry(localPairingRetry, func() error {
+		select {
+		case <-done:
+			return permanent(errPairingCancelled)
+		default:
+		}
+
+		master, err := findMaster(time.Second * 10)
+		if err != nil {
+			return err
+		}
+
+		if master == nil || master.PairingPort == 0 {
+			return errors.New("No master accepting join requests found")
+		}
+
+		grant, err = c.requestJoin(master, done)
+		if err == errPairingCancelled {
+			return permanent(err)
+		}
+		return err
+	})
+
+	return grant, err
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestJoinKeysAgree(t *testing.T) {
+	masterPriv, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterPublic := elliptic.Marshal(elliptic.P256(), x, y)
+
+	joinerPriv, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	joinerPublic := elliptic.Marshal(elliptic.P256(), x, y)
+
+	masterKey, masterCode, err := joinKeys(masterPriv, joinerPublic, masterPublic, joinerPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	joinerKey, joinerCode, err := joinKeys(joinerPriv, masterPublic, masterPublic, joinerPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(masterKey) != string(joinerKey) || masterCode != joinerCode {
+		t.Fatalf("Master and joiner disagree: %s vs %s", masterCode, joinerCode)
+	}
+
+}
+
+func TestApproveJoin(t *testing.T) {
+	joins := newPendingJoins()
+
+	if err := joins.approve("joiner", "123456", true); err != errNoPendingJoin {
+		t.Fatalf("Expected no pending join, got %v", err)
+	}
+
+	add := func() *pendingJoin {
+		join := &pendingJoin{
+			code:     "123456",
+			approved: make(chan bool, 1),
+			expires:  time.Now().Add(time.Minute),
+		}
+		joins.add("joiner", join)
+		return join
+	}
+
+	join := add()
+
+	if err := joins.approve("joiner", "654321", true); err != errWrongJoinCode {
+		t.Fatalf("Expected a wrong code, got %v", err)
+	}
+	if err := joins.approve("joiner", "123456", true); err != nil {
+		t.Fatalf("Failed to approve join: %s", err)
+	}
+	if !<-join.approved {
+		t.Fatal("Expected the join to be approved")
+	}
+
+	// Guessing the code
+	join = add()
+
+	for i := 1; i < maxJoinCodeAttempts; i++ {
+		if err := joins.approve("joiner", "000000", true); err != errWrongJoinCode {
+			t.Fatalf("Expected a wrong code, got %v", err)
+		}
+	}
+	if err := joins.approve("joiner", "000000", true); err != errJoinDenied {
+		t.Fatalf("Expected the join to be denied, got %v", err)
+	}
+	if <-join.approved {
+		t.Fatal("Expected the join to be denied")
+	}
+
+	// Denying doesn't need the code
+	join = add()
+
+	if err := joins.approve("joiner", "", false); err != nil {
+		t.Fatalf("Failed to deny join: %s", err)
+	}
+	if <-join.approved {
+		t.Fatal("Expected the join to be denied")
+	}
+}
@@ -0,0 +1,373 @@
+package client
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/mdns"
+	"github.com/miekg/dns"
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+// If set, peers are found by continuously browsing mDNS, instead of a lookup every 30 seconds.
+var mdnsBrowseEnabled = config.Bool(true, "client", "mdns", "browse")
+
+// How often the browser asks for the service again. Answers to anyone's queries, and
+// announcements, are seen as they happen in between.
+var mdnsQueryInterval = config.Duration(time.Minute, "client", "mdns", "queryInterval")
+
+var mdnsGroup = &net.UDPAddr{IP: net.ParseIP("224.0.0.251"), Port: 5353}
+
+// mdnsInstance is an instance of the service, built from its PTR, SRV and TXT records, each of
+// which expires separately.
+type mdnsInstance struct {
+	name       string
+	host       string
+	port       int
+	txt        []string
+	hasTXT     bool
+	ptrExpires time.Time
+	srvExpires time.Time
+	txtExpires time.Time
+}
+
+// expired returns whether the instance is gone, i.e. its PTR or SRV record has expired. The TXT
+// record usually lives much longer, so only counts if we have seen neither.
+func (inst *mdnsInstance) expired(now time.Time) bool {
+	if inst.ptrExpires.IsZero() && inst.srvExpires.IsZero() {
+		return now.After(inst.txtExpires)
+	}
+	return (!inst.ptrExpires.IsZero() && now.After(inst.ptrExpires)) ||
+		(!inst.srvExpires.IsZero() && now.After(inst.srvExpires))
+}
+
+type mdnsHost struct {
+	v4        net.IP
+	v6        net.IP
+	v4Expires time.Time
+	v6Expires time.Time
+}
+
+// mdnsBrowser listens to every mDNS response on the LAN, keeping a cache of the instances of a
+// service. onEntry is called whenever a complete instance is (re)announced, and onRemove when its
+// PTR or SRV record expires. A goodbye (a TTL of 0) just expires the record straight away. Queries
+// after the first few at startup are left to the caller.
+type mdnsBrowser struct {
+	sync.Mutex
+	service   string
+	instances map[string]*mdnsInstance
+	hosts     map[string]*mdnsHost
+	conn      *net.UDPConn
+	onEntry   func(*mdns.ServiceEntry)
+	onRemove  func(*mdns.ServiceEntry)
+}
+
+func newMdnsBrowser(service string, onEntry, onRemove func(*mdns.ServiceEntry)) *mdnsBrowser {
+	return &mdnsBrowser{
+		service:   dns.Fqdn(service + ".local"),
+		instances: make(map[string]*mdnsInstance),
+		hosts:     make(map[string]*mdnsHost),
+		onEntry:   onEntry,
+		onRemove:  onRemove,
+	}
+}
+
+func (b *mdnsBrowser) start() error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return err
+	}
+
+	b.Lock()
+	b.conn = conn
+	b.Unlock()
+
+	go b.listen()
+
+	go func() {
+		// Ask a few times quickly at startup, in case the first is lost.
+		for _, delay := range []time.Duration{0, time.Second, time.Second * 3} {
+			time.Sleep(delay)
+			b.query()
+		}
+
+		for range time.Tick(time.Second) {
+			b.expire()
+		}
+	}()
+
+	return nil
+}
+
+func (b *mdnsBrowser) running() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.conn != nil
+}
+
+// query asks for all the instances of the service.
+func (b *mdnsBrowser) query() {
+	msg := new(dns.Msg)
+	msg.SetQuestion(b.service, dns.TypePTR)
+	msg.RecursionDesired = false
+
+	data, err := msg.Pack()
+	if err != nil {
+		log.Warningf("Failed to pack mDNS query: %s", err)
+		return
+	}
+
+	if _, err := b.conn.WriteToUDP(data, mdnsGroup); err != nil {
+		log.Warningf("Failed to send mDNS query: %s", err)
+	}
+}
+
+func (b *mdnsBrowser) listen() {
+	buf := make([]byte, 65536)
+
+	for {
+		n, _, err := b.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Warningf("mDNS browser stopped: %s", err)
+			return
+		}
+
+		msg := new(dns.Msg)
+		if err := msg.Unpack(buf[:n]); err != nil || !msg.Response {
+			continue
+		}
+
+		b.handle(msg)
+	}
+}
+
+func (b *mdnsBrowser) handle(msg *dns.Msg) {
+
+	b.Lock()
+
+	now := time.Now()
+	touched := make(map[string]bool)
+	goodbyes := false
+
+	instance := func(name string) *mdnsInstance {
+		inst, ok := b.instances[name]
+		if !ok {
+			inst = &mdnsInstance{name: name}
+			b.instances[name] = inst
+		}
+		return inst
+	}
+
+	ours := func(name string) bool {
+		return strings.HasSuffix(name, "."+b.service)
+	}
+
+	records := append(append(msg.Answer, msg.Ns...), msg.Extra...)
+
+	for _, rr := range records {
+		hdr := rr.Header()
+		expires := now.Add(time.Duration(hdr.Ttl) * time.Second)
+
+		if hdr.Ttl == 0 {
+			// A goodbye expires the record straight away
+			expires = now.Add(-time.Second)
+			goodbyes = true
+		}
+
+		switch rr := rr.(type) {
+		case *dns.PTR:
+			if hdr.Name != b.service {
+				continue
+			}
+			if _, ok := b.instances[rr.Ptr]; !ok && hdr.Ttl == 0 {
+				continue
+			}
+			instance(rr.Ptr).ptrExpires = expires
+			touched[rr.Ptr] = hdr.Ttl > 0
+
+		case *dns.SRV:
+			if !ours(hdr.Name) {
+				continue
+			}
+			if _, ok := b.instances[hdr.Name]; !ok && hdr.Ttl == 0 {
+				continue
+			}
+			inst := instance(hdr.Name)
+			inst.srvExpires = expires
+			if hdr.Ttl > 0 {
+				inst.host, inst.port = rr.Target, int(rr.Port)
+			}
+			touched[hdr.Name] = hdr.Ttl > 0
+
+		case *dns.TXT:
+			if !ours(hdr.Name) {
+				continue
+			}
+			if _, ok := b.instances[hdr.Name]; !ok && hdr.Ttl == 0 {
+				continue
+			}
+			inst := instance(hdr.Name)
+			inst.txtExpires = expires
+			if hdr.Ttl > 0 {
+				inst.txt, inst.hasTXT = rr.Txt, true
+			}
+			touched[hdr.Name] = hdr.Ttl > 0
+
+		case *dns.A:
+			host := b.host(hdr.Name)
+			host.v4Expires = expires
+			if hdr.Ttl > 0 {
+				host.v4 = rr.A
+			}
+
+		case *dns.AAAA:
+			host := b.host(hdr.Name)
+			host.v6Expires = expires
+			if hdr.Ttl > 0 {
+				host.v6 = rr.AAAA
+			}
+		}
+	}
+
+	// An address may arrive separately from the service records that refer to it.
+	for _, rr := range records {
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA:
+			if rr.Header().Ttl == 0 {
+				continue
+			}
+			for name, inst := range b.instances {
+				if inst.host == rr.Header().Name {
+					touched[name] = true
+				}
+			}
+		}
+	}
+
+	var entries []*mdns.ServiceEntry
+	for name, announced := range touched {
+		if inst := b.instances[name]; announced && !inst.expired(now) {
+			if entry := b.entry(inst); entry != nil {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	b.Unlock()
+
+	if goodbyes {
+		b.expire()
+	}
+
+	for _, entry := range entries {
+		b.onEntry(entry)
+	}
+}
+
+// host must be called with the lock held.
+func (b *mdnsBrowser) host(name string) *mdnsHost {
+	host, ok := b.hosts[name]
+	if !ok {
+		host = &mdnsHost{}
+		b.hosts[name] = host
+	}
+	return host
+}
+
+// entry returns the instance as a ServiceEntry, or nil if we don't know all of it yet. Must be
+// called with the lock held.
+func (b *mdnsBrowser) entry(inst *mdnsInstance) *mdns.ServiceEntry {
+	if inst == nil || inst.port == 0 || !inst.hasTXT {
+		return nil
+	}
+
+	host, ok := b.hosts[inst.host]
+	if !ok || (host.v4 == nil && host.v6 == nil) {
+		return nil
+	}
+
+	entry := &mdns.ServiceEntry{
+		Name:       inst.name,
+		Host:       inst.host,
+		AddrV4:     host.v4,
+		AddrV6:     host.v6,
+		Port:       inst.port,
+		Info:       strings.Join(inst.txt, "|"),
+		InfoFields: inst.txt,
+	}
+
+	entry.Addr = entry.AddrV4
+	if entry.Addr == nil {
+		entry.Addr = entry.AddrV6
+	}
+
+	return entry
+}
+
+// entries returns all the complete instances in the cache.
+func (b *mdnsBrowser) entries() []*mdns.ServiceEntry {
+	b.Lock()
+	defer b.Unlock()
+
+	var entries []*mdns.ServiceEntry
+	for _, inst := range b.instances {
+		if entry := b.entry(inst); entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// expire drops instances and addresses whose records have passed their TTL, calling onRemove for
+// each instance that goes.
+func (b *mdnsBrowser) expire() {
+	b.Lock()
+
+	now := time.Now()
+	var removed []*mdns.ServiceEntry
+
+	for name, inst := range b.instances {
+		if !inst.expired(now) {
+			continue
+		}
+
+		if inst.hasTXT {
+			removed = append(removed, &mdns.ServiceEntry{
+				Name:       inst.name,
+				Host:       inst.host,
+				Port:       inst.port,
+				Info:       strings.Join(inst.txt, "|"),
+				InfoFields: inst.txt,
+			})
+		}
+		delete(b.instances, name)
+	}
+
+	for name, host := range b.hosts {
+		if now.After(host.v4Expires) {
+			host.v4 = nil
+		}
+		if now.After(host.v6Expires) {
+			host.v6 = nil
+		}
+		if host.v4 == nil && host.v6 == nil {
+			delete(b.hosts, name)
+		}
+	}
+
+	for _, inst := range b.instances {
+		if inst.hasTXT && now.After(inst.txtExpires) {
+			inst.txt, inst.hasTXT = nil, false
+		}
+	}
+
+	b.Unlock()
+
+	for _, entry := range removed {
+		if b.onRemove != nil {
+			b.onRemove(entry)
+		}
+	}
+}
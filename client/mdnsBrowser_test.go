@@ -0,0 +1,83 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/mdns"
+	"github.com/miekg/dns"
+)
+
+const testService = "_ninja-homecloud-mqtt._tcp.local."
+
+func announcement(ttl, txtTTL uint32) *dns.Msg {
+	instance := "node-1." + testService
+	header := func(name string, rrtype uint16, ttl uint32) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+	}
+
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = []dns.RR{
+		&dns.PTR{Hdr: header(testService, dns.TypePTR, ttl), Ptr: instance},
+		&dns.SRV{Hdr: header(instance, dns.TypeSRV, ttl), Target: "node-1.local.", Port: 1883},
+		&dns.TXT{Hdr: header(instance, dns.TypeTXT, txtTTL), Txt: []string{"ninja.sphere.node_id=node-1"}},
+		&dns.A{Hdr: header("node-1.local.", dns.TypeA, ttl), A: net.ParseIP("10.0.0.2")},
+	}
+	return msg
+}
+
+func testBrowser() (*mdnsBrowser, *[]string, *[]string) {
+	var entries, removed []string
+	b := newMdnsBrowser("_ninja-homecloud-mqtt._tcp", func(entry *mdns.ServiceEntry) {
+		entries = append(entries, entry.Info)
+	}, func(entry *mdns.ServiceEntry) {
+		removed = append(removed, entry.Info)
+	})
+	return b, &entries, &removed
+}
+
+func TestMdnsBrowserExpiresOnSRV(t *testing.T) {
+	b, entries, removed := testBrowser()
+
+	b.handle(announcement(120, 4500))
+
+	if len(*entries) != 1 || (*entries)[0] != "ninja.sphere.node_id=node-1" {
+		t.Fatalf("Expected the instance to be found, got %v", *entries)
+	}
+
+	// The SRV record has expired, but the TXT record hasn't.
+	b.Lock()
+	b.instances["node-1."+testService].srvExpires = time.Now().Add(-time.Second)
+	b.Unlock()
+
+	b.expire()
+
+	if len(*removed) != 1 || (*removed)[0] != "ninja.sphere.node_id=node-1" {
+		t.Fatalf("Expected the instance to be removed when its SRV record expired, got %v", *removed)
+	}
+	if len(b.entries()) != 0 {
+		t.Fatal("Expired instance is still cached")
+	}
+}
+
+func TestMdnsBrowserGoodbye(t *testing.T) {
+	b, _, removed := testBrowser()
+
+	b.handle(announcement(120, 4500))
+	b.handle(announcement(0, 0))
+
+	if len(*removed) != 1 {
+		t.Fatalf("Expected a goodbye to remove the instance, got %v", *removed)
+	}
+	if len(b.entries()) != 0 {
+		t.Fatal("Instance is still cached after saying goodbye")
+	}
+
+	// A goodbye for something we never saw is ignored.
+	b.handle(announcement(0, 0))
+	if len(*removed) != 1 {
+		t.Fatalf("Unexpected removal: %v", *removed)
+	}
+}
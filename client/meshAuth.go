@@ -0,0 +1,254 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/bus"
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+// Slaves challenge the master to prove it knows the sphere network key, and refuse to bridge to
+// masters that fail. Older masters don't answer, so to mesh with one this has to be turned off on
+// its slaves, which then only warn and bridge anyway.
+//
+// The proof covers the address the slave connected to, and masters only answer for their own
+// addresses, so a node can't pass by relaying the challenge to the real master. Something that
+// can take over the master's address on the LAN still can.
+var bridgeRequireAuth = config.Bool(true, "client", "bridge", "requireAuth")
+
+// Slaves also log in to the master's mqtt broker with a username and password derived from the
+// sphere network key, so the master's broker can be configured to only accept nodes in the mesh.
+// Turn this off for masters whose broker rejects them.
+var bridgeBrokerAuth = config.Bool(true, "client", "bridge", "brokerAuth")
+
+var bridgeAuthTimeout = config.Duration(time.Second*5, "client", "bridge", "authTimeout")
+
+var errNoNetworkKey = errors.New("No sphere network key")
+
+// networkKey returns the sphere network key shared by all the nodes in a site.
+func networkKey() ([]byte, error) {
+	creds, err := loadCreds()
+	if err != nil {
+		return nil, err
+	}
+
+	if creds.SphereNetworkKey == "" {
+		return nil, errNoNetworkKey
+	}
+
+	return []byte(creds.SphereNetworkKey), nil
+}
+
+// meshMAC returns a hex HMAC of the parts, keyed by the sphere network key.
+func meshMAC(key []byte, parts ...string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join(parts, "|")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func validMeshMAC(key []byte, mac string, parts ...string) bool {
+	return hmac.Equal([]byte(mac), []byte(meshMAC(key, parts...)))
+}
+
+// brokerCredentials returns the username and password a slave uses to log in to the master's
+// mqtt broker.
+func brokerCredentials(key []byte, serial string) (username, password string) {
+	return "slave-" + serial, meshMAC(key, "mqtt", serial)
+}
+
+// The mDNS TXT fields covered by ninja.sphere.mesh_sig, in the order they are signed.
+var signedTXTFields = []string{"node_id", "user_id", "site_id", "site_updated", "master_node_id", "master"}
+
+// meshTXTSignature signs the mesh fields of a node's TXT records, given without the "ninja.sphere."
+// prefix.
+func meshTXTSignature(key []byte, txt map[string]string) string {
+	parts := make([]string, len(signedTXTFields))
+	for i, field := range signedTXTFields {
+		parts[i] = txt[field]
+	}
+	return meshMAC(append([]byte("txt|"), key...), parts...)
+}
+
+// verifyMeshTXT checks the mesh_sig of TXT records as parsed by parseMdnsInfo.
+func verifyMeshTXT(key []byte, info map[string]string) bool {
+	txt := make(map[string]string)
+	for _, field := range signedTXTFields {
+		txt[field] = info["ninja.sphere."+field]
+	}
+	return hmac.Equal([]byte(info["ninja.sphere.mesh_sig"]), []byte(meshTXTSignature(key, txt)))
+}
+
+// bridgeChallenge is sent by a slave to the master it has connected to at Host.
+type bridgeChallenge struct {
+	NodeID string `json:"nodeId"`
+	Nonce  string `json:"nonce"`
+	Host   string `json:"host,omitempty"`
+	Proof  string `json:"proof"`
+}
+
+type bridgeChallengeResponse struct {
+	NodeID string `json:"nodeId"`
+	Nonce  string `json:"nonce"`
+	Proof  string `json:"proof"`
+}
+
+// challengeMAC returns the proof for a challenge or response. Challenges from older slaves have
+// no host.
+func challengeMAC(key []byte, role, nodeID, nonce, host string) string {
+	if host == "" {
+		return meshMAC(key, role, nodeID, nonce)
+	}
+	return meshMAC(key, role, nodeID, nonce, host)
+}
+
+// authenticateMaster checks the master at masterURL, as described for bridgeRequireAuth.
+func (c *client) authenticateMaster(masterBus bus.Bus, masterURL string) error {
+
+	err := c.challengeMaster(masterBus, masterURL)
+
+	if err != nil && !bridgeRequireAuth {
+		log.Warningf("Bridging to unauthenticated master at %s: %s", masterURL, err)
+		return nil
+	}
+
+	return err
+}
+
+// challengeMaster challenges the master to prove it knows the network key, proving that we do at
+// the same time.
+func (c *client) challengeMaster(masterBus bus.Bus, masterURL string) error {
+
+	host, _, err := net.SplitHostPort(masterURL)
+	if err != nil {
+		return fmt.Errorf("Invalid master address %s: %s", masterURL, err)
+	}
+
+	key, err := networkKey()
+	if err != nil {
+		return fmt.Errorf("Can't authenticate master: %s", err)
+	}
+
+	nonce, err := randomID()
+	if err != nil {
+		return err
+	}
+
+	masterID := config.MustString("masterNodeId")
+	responses := make(chan *bridgeChallengeResponse, 1)
+
+	sub, err := masterBus.Subscribe(fmt.Sprintf("$node/%s/client/auth/response", config.Serial()), func(topic string, payload []byte) {
+		var response bridgeChallengeResponse
+		if err := json.Unmarshal(payload, &response); err != nil {
+			log.Warningf("Invalid auth response from master: %s", err)
+			return
+		}
+		if response.Nonce != nonce {
+			return
+		}
+		select {
+		case responses <- &response:
+		default:
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer sub.Cancel()
+
+	challenge, err := json.Marshal(&bridgeChallenge{
+		NodeID: config.Serial(),
+		Nonce:  nonce,
+		Host:   host,
+		Proof:  challengeMAC(key, "slave", config.Serial(), nonce, host),
+	})
+	if err != nil {
+		return err
+	}
+
+	masterBus.Publish(fmt.Sprintf("$node/%s/client/auth/challenge", masterID), challenge)
+
+	select {
+	case response := <-responses:
+		if response.NodeID != masterID || !hmac.Equal([]byte(response.Proof), []byte(challengeMAC(key, "master", masterID, nonce, host))) {
+			return fmt.Errorf("Master %s failed to prove it knows the network key", masterID)
+		}
+	case <-time.After(bridgeAuthTimeout):
+		return fmt.Errorf("Timed out waiting for master %s to authenticate", masterID)
+	}
+
+	log.Infof("Master %s authenticated", masterID)
+
+	return nil
+}
+
+// answerBridgeChallenges proves to slaves that we know the network key, if they do too. Only
+// run on the master.
+func (c *client) answerBridgeChallenges() {
+
+	topic := fmt.Sprintf("$node/%s/client/auth/challenge", config.Serial())
+
+	sub, err := c.conn.SubscribeRaw(topic, func(challenge *bridgeChallenge) bool {
+		key, err := networkKey()
+		if err != nil {
+			log.Warningf("Can't answer auth challenge from %s: %s", challenge.NodeID, err)
+			return true
+		}
+
+		if !hmac.Equal([]byte(challenge.Proof), []byte(challengeMAC(key, "slave", challenge.NodeID, challenge.Nonce, challenge.Host))) {
+			log.Warningf("Node %s failed to prove it knows the network key. Ignoring its challenge.", challenge.NodeID)
+			return true
+		}
+
+		if challenge.Host != "" && !isLocalAddress(challenge.Host) {
+			log.Warningf("Node %s connected to %s, which isn't us. Ignoring its challenge.", challenge.NodeID, challenge.Host)
+			return true
+		}
+
+		c.conn.PublishRaw(fmt.Sprintf("$node/%s/client/auth/response", challenge.NodeID), &bridgeChallengeResponse{
+			NodeID: config.Serial(),
+			Nonce:  challenge.Nonce,
+			Proof:  challengeMAC(key, "master", config.Serial(), challenge.Nonce, challenge.Host),
+		})
+
+		return true
+	})
+
+	if err != nil {
+		log.Warningf("Failed to subscribe to bridge auth challenges: %s", err)
+		return
+	}
+
+	c.mu.Lock()
+	c.masterSubscriptions = append(c.masterSubscriptions, sub)
+	c.mu.Unlock()
+}
+
+// isLocalAddress returns whether host is one of the addresses of this node's interfaces.
+func isLocalAddress(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Warningf("Failed to list interface addresses: %s", err)
+		return false
+	}
+
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
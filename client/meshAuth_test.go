@@ -0,0 +1,60 @@
+package client
+
+import "testing"
+
+func TestChallengeBoundToHost(t *testing.T) {
+	key := []byte("network-key")
+
+	proof := challengeMAC(key, "master", "master-1", "nonce", "10.0.0.2")
+	if proof == challengeMAC(key, "master", "master-1", "nonce", "10.0.0.3") {
+		t.Fatal("A proof for one address passes for another")
+	}
+
+	if !isLocalAddress("127.0.0.1") {
+		t.Fatal("Expected loopback to be a local address")
+	}
+	if isLocalAddress("192.0.2.1") || isLocalAddress("not-an-ip") {
+		t.Fatal("Expected a foreign address not to be local")
+	}
+}
+
+func TestUnsignedMdnsInfoNeedsNetworkKey(t *testing.T) {
+	defer withTempFiles(t)()
+
+	info := map[string]string{
+		"ninja.sphere.node_id":        "spoofer",
+		"ninja.sphere.user_id":        "user-1",
+		"ninja.sphere.site_id":        "site-1",
+		"ninja.sphere.site_updated":   "2000000000",
+		"ninja.sphere.master_node_id": "spoofer",
+		"ninja.sphere.master":         "true",
+	}
+
+	c := &client{}
+
+	if !c.trustMdnsInfo(info) {
+		t.Fatal("Expected unsigned records to be trusted without a network key")
+	}
+
+	if err := saveCreds(&Credentials{UserID: "user-1", Token: "token-1", SphereNetworkKey: "network-key"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.trustMdnsInfo(info) {
+		t.Fatal("Unsigned records were trusted with a network key")
+	}
+
+	info["ninja.sphere.mesh_sig"] = meshTXTSignature([]byte("another-key"), map[string]string{"node_id": "spoofer"})
+	if c.trustMdnsInfo(info) {
+		t.Fatal("Records signed with another key were trusted")
+	}
+
+	txt := make(map[string]string)
+	for _, field := range signedTXTFields {
+		txt[field] = info["ninja.sphere."+field]
+	}
+	info["ninja.sphere.mesh_sig"] = meshTXTSignature([]byte("network-key"), txt)
+	if !c.trustMdnsInfo(info) {
+		t.Fatal("Records signed with the network key weren't trusted")
+	}
+}
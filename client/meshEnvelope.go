@@ -0,0 +1,198 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+// Messages that have crossed more bridges than this are dropped.
+var maxMeshHops = config.Int(4, "client", "bridge", "maxHops")
+
+// How long we remember non-object payloads we have bridged, so we can drop them if they come back.
+var meshEchoTimeout = config.Duration(time.Second*5, "client", "bridge", "echoTimeout")
+
+const (
+	meshSourceField = "$mesh-source"
+	meshHopsField   = "$mesh-hops"
+	meshPathField   = "$mesh-path"
+)
+
+// meshEnvelope is carried in the fields of JSON object payloads as they cross bridges. Source is
+// the node the message originated on, and Path the nodes that have bridged it so far.
+type meshEnvelope struct {
+	Source string
+	Hops   int
+	Path   []string
+}
+
+func (e *meshEnvelope) visited(node string) bool {
+	if e.Source == node {
+		return true
+	}
+	for _, n := range e.Path {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// readMeshEnvelope parses a JSON object payload, returning its fields and envelope. ok is false if
+// the payload isn't a JSON object.
+func readMeshEnvelope(payload []byte) (fields map[string]json.RawMessage, envelope meshEnvelope, ok bool) {
+
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, envelope, false
+	}
+
+	if err := json.Unmarshal(trimmed, &fields); err != nil {
+		return nil, envelope, false
+	}
+
+	if raw, ok := fields[meshSourceField]; ok {
+		json.Unmarshal(raw, &envelope.Source)
+	}
+	if raw, ok := fields[meshHopsField]; ok {
+		json.Unmarshal(raw, &envelope.Hops)
+	}
+	if raw, ok := fields[meshPathField]; ok {
+		json.Unmarshal(raw, &envelope.Path)
+	}
+
+	return fields, envelope, true
+}
+
+// writeMeshEnvelope re-marshals the payload fields with the envelope added.
+func writeMeshEnvelope(fields map[string]json.RawMessage, envelope meshEnvelope) ([]byte, error) {
+
+	var err error
+
+	if fields[meshSourceField], err = json.Marshal(envelope.Source); err != nil {
+		return nil, err
+	}
+	if fields[meshHopsField], err = json.Marshal(envelope.Hops); err != nil {
+		return nil, err
+	}
+	if fields[meshPathField], err = json.Marshal(envelope.Path); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(fields)
+}
+
+// meshEchoes remembers payloads that couldn't carry an envelope (anything that isn't a JSON
+// object), so if we see them come back across the bridge they can be dropped.
+type meshEchoes struct {
+	sync.Mutex
+	seen map[string]time.Time
+}
+
+func echoKey(masterToSlave bool, topic string, payload []byte) string {
+	return fmt.Sprintf("%t|%s|%x", masterToSlave, topic, sha1.Sum(payload))
+}
+
+// add records that we have bridged a payload in the given direction.
+func (e *meshEchoes) add(masterToSlave bool, topic string, payload []byte) {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.seen == nil {
+		e.seen = make(map[string]time.Time)
+	}
+
+	now := time.Now()
+	for key, t := range e.seen {
+		if now.Sub(t) > meshEchoTimeout {
+			delete(e.seen, key)
+		}
+	}
+
+	e.seen[echoKey(masterToSlave, topic, payload)] = now
+}
+
+// isEcho returns true (and forgets about it) if we bridged the payload in the other direction.
+func (e *meshEchoes) isEcho(masterToSlave bool, topic string, payload []byte) bool {
+	e.Lock()
+	defer e.Unlock()
+
+	key := echoKey(!masterToSlave, topic, payload)
+
+	t, ok := e.seen[key]
+	if !ok {
+		return false
+	}
+
+	delete(e.seen, key)
+	return time.Since(t) <= meshEchoTimeout
+}
+
+// filterBridgeMessage stops messages looping around the mesh. JSON objects carry an envelope
+// recording where they came from and which nodes have bridged them. Anything else is passed
+// through as-is, and dropped if it comes straight back.
+func (c *client) filterBridgeMessage(masterToSlave bool, topic string, payload []byte) ([]byte, bool) {
+
+	if masterToSlave {
+		// This is a message from master, clear the timeout
+		c.touchMaster()
+		if c.state.is(stateOrphaned) {
+			c.setUnorphaned()
+		}
+	}
+
+	if !masterToSlave {
+		c.mu.Lock()
+		devices := c.devices
+		c.mu.Unlock()
+
+		if devices != nil && !devices.owned(topic) {
+			return nil, false
+		}
+	}
+
+	fields, envelope, ok := readMeshEnvelope(payload)
+
+	if !ok {
+		if c.echoes.isEcho(masterToSlave, topic, payload) {
+			log.Debugf("Mesh master2slave:%t topic:%s dropping echoed non-object payload", masterToSlave, topic)
+			return nil, false
+		}
+
+		c.echoes.add(masterToSlave, topic, payload)
+		return payload, true
+	}
+
+	// Interesting if we haven't already seen it, and it hasn't been around too long
+	interesting := !envelope.visited(config.Serial()) && envelope.Hops < maxMeshHops
+
+	log.Infof("Mesh master2slave:%t topic:%s interesting:%t", masterToSlave, topic, interesting)
+
+	if !interesting {
+		return nil, false
+	}
+
+	if envelope.Source == "" {
+		if masterToSlave {
+			envelope.Source = config.MustString("masterNodeId")
+		} else {
+			envelope.Source = config.Serial()
+		}
+	}
+
+	envelope.Hops++
+	envelope.Path = append(envelope.Path, config.Serial())
+
+	payload, err := writeMeshEnvelope(fields, envelope)
+	if err != nil {
+		log.Warningf("Failed to add mesh envelope to message on %s: %s", topic, err)
+		return nil, false
+	}
+
+	return payload, true
+}
@@ -0,0 +1,168 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+func testFilterClient(state clientState) *client {
+	return &client{state: newStateMachine(state)}
+}
+
+func TestFilterBridgeMessage(t *testing.T) {
+	me := config.Serial()
+
+	tests := []struct {
+		name          string
+		masterToSlave bool
+		payload       string
+		bridged       bool
+		envelope      meshEnvelope
+	}{
+		{
+			name:     "empty object",
+			payload:  `{}`,
+			bridged:  true,
+			envelope: meshEnvelope{Source: me, Hops: 1, Path: []string{me}},
+		},
+		{
+			name:          "whitespace before an object",
+			masterToSlave: true,
+			payload:       " \n\t{\"state\":true}",
+			bridged:       true,
+			envelope:      meshEnvelope{Source: config.MustString("masterNodeId"), Hops: 1, Path: []string{me}},
+		},
+		{
+			name:     "from another slave",
+			payload:  `{"$mesh-source":"slave-a","$mesh-hops":1,"$mesh-path":["slave-a"]}`,
+			bridged:  true,
+			envelope: meshEnvelope{Source: "slave-a", Hops: 2, Path: []string{"slave-a", me}},
+		},
+		{
+			name:    "already bridged by us",
+			payload: `{"$mesh-source":"slave-a","$mesh-hops":2,"$mesh-path":["slave-a","` + me + `"]}`,
+		},
+		{
+			name:          "from us",
+			masterToSlave: true,
+			payload:       `{"$mesh-source":"` + me + `","$mesh-hops":1,"$mesh-path":["` + me + `"]}`,
+		},
+		{
+			name:     "one hop under the limit",
+			payload:  `{"$mesh-source":"slave-a","$mesh-hops":3}`,
+			bridged:  true,
+			envelope: meshEnvelope{Source: "slave-a", Hops: 4, Path: []string{me}},
+		},
+		{
+			name:    "at the hop limit",
+			payload: `{"$mesh-source":"slave-a","$mesh-hops":4}`,
+		},
+		{
+			name:    "over the hop limit",
+			payload: `{"$mesh-source":"slave-a","$mesh-hops":40}`,
+		},
+	}
+
+	for _, test := range tests {
+		c := testFilterClient(stateSlaveBridged)
+
+		payload, ok := c.filterBridgeMessage(test.masterToSlave, "$node/test/event", []byte(test.payload))
+		if ok != test.bridged {
+			t.Errorf("%s: expected bridged:%t, got %t", test.name, test.bridged, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		_, envelope, isObject := readMeshEnvelope(payload)
+		if !isObject {
+			t.Errorf("%s: bridged payload isn't an object: %s", test.name, payload)
+			continue
+		}
+
+		if envelope.Source != test.envelope.Source || envelope.Hops != test.envelope.Hops || len(envelope.Path) != len(test.envelope.Path) {
+			t.Errorf("%s: expected envelope %+v, got %+v", test.name, test.envelope, envelope)
+			continue
+		}
+		for i := range envelope.Path {
+			if envelope.Path[i] != test.envelope.Path[i] {
+				t.Errorf("%s: expected envelope %+v, got %+v", test.name, test.envelope, envelope)
+			}
+		}
+	}
+}
+
+// Arrays and scalars can't carry an envelope, so are passed through as-is and only dropped if they
+// come straight back the other way.
+func TestFilterBridgeMessageNonObjects(t *testing.T) {
+	payloads := []string{`[1,2,3]`, ` ["a"]`, `"hello"`, `42`, `true`, `null`, `not json`, ``}
+
+	for _, payload := range payloads {
+		c := testFilterClient(stateSlaveBridged)
+
+		bridged, ok := c.filterBridgeMessage(false, "$node/test/event", []byte(payload))
+		if !ok || string(bridged) != payload {
+			t.Errorf("Expected %q to be passed through, got %q (%t)", payload, bridged, ok)
+			continue
+		}
+
+		if _, ok := c.filterBridgeMessage(true, "$node/test/event", []byte(payload)); ok {
+			t.Errorf("Expected %q to be dropped when it came back", payload)
+		}
+
+		// It's only dropped once
+		if _, ok := c.filterBridgeMessage(true, "$node/test/event", []byte(payload)); !ok {
+			t.Errorf("Expected %q to be bridged again", payload)
+		}
+	}
+}
+
+// TestFilterBridgeMessageRelay follows a message from slave A, through the master, to slave B (us),
+// where it must not be bridged back to the master.
+func TestFilterBridgeMessageRelay(t *testing.T) {
+	slaveA := testFilterClient(stateSlaveBridged)
+
+	// A's bridge sends it to the master. A's serial is ours too, so rename it in the envelope.
+	toMaster, ok := slaveA.filterBridgeMessage(false, "$device/a/event/state", []byte(`{"on":true}`))
+	if !ok {
+		t.Fatal("Expected the message to be bridged to the master")
+	}
+
+	fields, envelope, _ := readMeshEnvelope(toMaster)
+	envelope.Source, envelope.Path = "slave-a", []string{"slave-a"}
+	toMaster, _ = writeMeshEnvelope(fields, envelope)
+
+	// B's bridge hears it from the master, and publishes it locally
+	slaveB := testFilterClient(stateSlaveBridged)
+
+	local, ok := slaveB.filterBridgeMessage(true, "$device/a/event/state", toMaster)
+	if !ok {
+		t.Fatal("Expected the message to be bridged from the master")
+	}
+
+	_, envelope, _ = readMeshEnvelope(local)
+	if envelope.Source != "slave-a" || envelope.Hops != 2 || len(envelope.Path) != 2 || envelope.Path[1] != config.Serial() {
+		t.Fatalf("Unexpected envelope %+v", envelope)
+	}
+
+	// B's bridge also hears it locally, and must not send it back to the master
+	if _, ok := slaveB.filterBridgeMessage(false, "$device/a/event/state", local); ok {
+		t.Fatal("Message was echoed back to the master")
+	}
+}
+
+func TestFilterBridgeMessageUnorphans(t *testing.T) {
+	c := testFilterClient(stateOrphaned)
+
+	if _, ok := c.filterBridgeMessage(true, "$node/master/event", []byte(`{}`)); !ok {
+		t.Fatal("Expected the message to be bridged")
+	}
+
+	c.state.wait()
+
+	if !c.state.is(stateSlaveBridged) {
+		t.Fatal("Expected hearing from the master to unorphan us")
+	}
+}
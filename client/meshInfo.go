@@ -4,8 +4,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"os/exec"
 	"time"
 
 	"github.com/ninjasphere/go-ninja/config"
@@ -18,16 +16,19 @@ type meshInfo struct {
 	MasterNodeID string `json:"masterNodeId"`
 	SiteUpdated  int    `json:"siteUpdated"`
 	NoMesh       bool   `json:"noMesh"`
+	// ElectedFrom is the master we were given by the cloud, if the current master was elected
+	// locally in its absence.
+	ElectedFrom string `json:"electedFrom,omitempty"`
 }
 
-func refreshMeshInfo() (*meshInfo, error) {
+func refreshMeshInfo(cloud CloudAPI) (*meshInfo, error) {
 
-	nodes, err := getNodes()
+	nodes, err := cloud.Nodes()
 	if err != nil {
 		return nil, err
 	}
 
-	sites, err := getSites()
+	sites, err := cloud.Sites()
 	if err != nil {
 		return nil, err
 	}
@@ -50,12 +51,39 @@ func refreshMeshInfo() (*meshInfo, error) {
 		SiteID:       site.ID,
 		MasterNodeID: site.MasterNodeID,
 		SiteUpdated:  int(time.Time(site.Updated).UnixNano() / int64(time.Second)),
-		NoMesh: false,
+		NoMesh:       false,
+	}
+
+	// If the cloud's master went missing and we elected another, keep it until the site changes in
+	// the cloud. Otherwise every restart would undo the election.
+	if existing, err := loadMeshInfo(); err == nil && existing.ElectedFrom != "" &&
+		existing.ElectedFrom == meshInfo.MasterNodeID &&
+		existing.SiteID == meshInfo.SiteID &&
+		existing.SiteUpdated == meshInfo.SiteUpdated {
+
+		log.Infof("Keeping elected master %s in place of %s", existing.MasterNodeID, existing.ElectedFrom)
+		meshInfo.MasterNodeID = existing.MasterNodeID
+		meshInfo.ElectedFrom = existing.ElectedFrom
 	}
 
 	return meshInfo, saveMeshInfo(meshInfo)
 }
 
+// loadMeshInfo reads the saved mesh info.
+func loadMeshInfo() (*meshInfo, error) {
+	data, err := loadFile(meshFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var mesh meshInfo
+	if err := json.Unmarshal(data, &mesh); err != nil {
+		return nil, fmt.Errorf("Failed to parse mesh info file %s: %s", meshFile, err)
+	}
+
+	return &mesh, nil
+}
+
 func saveMeshInfo(mesh *meshInfo) error {
 
 	log.Infof("Saving mesh info to %s", meshFile)
@@ -66,18 +94,11 @@ func saveMeshInfo(mesh *meshInfo) error {
 	}
 
 	// XXX: HACK: TODO: CHANGE ME BACK TO 600
-	err = ioutil.WriteFile(meshFile, meshJSON, 0644)
+	err = saveFile(meshFile, meshJSON, 0644)
 
 	if err != nil {
 		return fmt.Errorf("Failed to write mesh info file: %s", err)
 	}
 
-	cmd := exec.Command("sync")
-	out, err := cmd.Output()
-
-	if err != nil {
-		return fmt.Errorf("Failed to call sync after saving mesh info: %s - %s", err, out)
-	}
-
 	return nil
 }
@@ -0,0 +1,322 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/config"
+
+	ledmodel "github.com/ninjasphere/sphere-go-led-controller/model"
+)
+
+// Commands sent to a node device must be signed with the network key, by the site's master, within
+// this long of being sent.
+var nodeCommandWindow = config.Duration(time.Minute, "client", "commands", "window")
+
+// The topic of another node's device, given its serial twice. Used by the master to send commands.
+var nodeDeviceTopic = config.String("$node/%s/driver/sphere-client/device/%s", "client", "commands", "deviceTopic")
+
+// Apps sign the commands they ask the master to relay with their own key, from this file (a JSON
+// object of app id to key). HomeCloud adds an app's key once it has been authorized through the
+// user's session, and removes it to revoke the app. The network key never leaves the nodes.
+var appKeysFile = config.String("/data/etc/opt/ninja/app-keys.json", "client", "commands", "appKeysFile")
+
+var nodeIdentifyIcon = config.String("identify.gif", "client", "commands", "identifyIcon")
+var nodeIdentifyDuration = config.Duration(time.Second*10, "client", "commands", "identifyDuration")
+
+// NodeCommand is the argument to each of the node device's methods, proving it was sent by the
+// master. Proof is the HMAC of the method, target node, sender and time (unix ms), keyed by the
+// sphere network key.
+type NodeCommand struct {
+	NodeID string `json:"nodeId"`
+	Time   int64  `json:"time"`
+	Proof  string `json:"proof"`
+}
+
+// NodeRelay is the argument to the master's sendCommand method, asking it to send a command to a
+// node in the site (the app can't sign commands as the master). Proof is the HMAC of "relay", the
+// app id, method, target node and time (unix ms), keyed by the app's key (see appKeysFile).
+type NodeRelay struct {
+	AppID  string `json:"appId"`
+	Target string `json:"target"`
+	Method string `json:"method"`
+	Time   int64  `json:"time"`
+	Proof  string `json:"proof"`
+}
+
+// The node device methods that can be relayed.
+var relayedNodeMethods = map[string]bool{
+	"reboot":         true,
+	"restartClient":  true,
+	"unpair":         true,
+	"rediscover":     true,
+	"identify":       true,
+	"getDiagnostics": true,
+}
+
+// NodeDiagnostics is returned by getDiagnostics.
+type NodeDiagnostics struct {
+	Status  *clientStatus `json:"status"`
+	Peers   []peerInfo    `json:"peers"`
+	Version string        `json:"version"`
+	Uptime  float64       `json:"uptime,omitempty"`
+	Load    *loadAverage  `json:"load,omitempty"`
+	Memory  *memoryUsage  `json:"memory,omitempty"`
+	Disk    *diskUsage    `json:"disk,omitempty"`
+}
+
+// signNodeCommand signs a command to be sent from us to the target node.
+func signNodeCommand(key []byte, method, target string) *NodeCommand {
+	cmd := &NodeCommand{
+		NodeID: config.Serial(),
+		Time:   time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	cmd.Proof = meshMAC(key, "command", method, target, cmd.NodeID, strconv.FormatInt(cmd.Time, 10))
+	return cmd
+}
+
+// nodeCommandReplays remembers the proofs of commands we have accepted, so they can't be replayed
+// within the window.
+type nodeCommandReplays struct {
+	sync.Mutex
+	seen map[string]time.Time
+}
+
+func (r *nodeCommandReplays) check(proof string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.seen == nil {
+		r.seen = make(map[string]time.Time)
+	}
+
+	for p, t := range r.seen {
+		if time.Since(t) > nodeCommandWindow*2 {
+			delete(r.seen, p)
+		}
+	}
+
+	if _, ok := r.seen[proof]; ok {
+		return false
+	}
+
+	r.seen[proof] = time.Now()
+	return true
+}
+
+// authorize checks that a command was signed by the site's master.
+func (d *NodeDevice) authorize(method string, cmd *NodeCommand) error {
+
+	if cmd == nil {
+		return fmt.Errorf("Unauthorized %s: missing command", method)
+	}
+
+	if cmd.NodeID != config.String("", "masterNodeId") {
+		return fmt.Errorf("Unauthorized %s: node %s is not the master", method, cmd.NodeID)
+	}
+
+	key, err := networkKey()
+	if err != nil {
+		return fmt.Errorf("Unauthorized %s: %s", method, err)
+	}
+
+	if err := d.checkSigned(method, key, cmd.Time, cmd.Proof, "command", method, config.Serial(), cmd.NodeID, strconv.FormatInt(cmd.Time, 10)); err != nil {
+		return err
+	}
+
+	log.Infof("Node %s called %s", cmd.NodeID, method)
+
+	return nil
+}
+
+// checkSigned checks that a command sent at sent (unix ms) is within the window, has a proof of
+// the parts keyed by key, and hasn't been used before.
+func (d *NodeDevice) checkSigned(method string, key []byte, sent int64, proof string, parts ...string) error {
+
+	if age := time.Since(time.Unix(0, sent*int64(time.Millisecond))); age > nodeCommandWindow || age < -nodeCommandWindow {
+		return fmt.Errorf("Unauthorized %s: command was sent %s ago", method, age)
+	}
+
+	if !validMeshMAC(key, proof, parts...) {
+		return fmt.Errorf("Unauthorized %s: invalid proof", method)
+	}
+
+	if !d.replays.check(proof) {
+		return fmt.Errorf("Unauthorized %s: command has already been used", method)
+	}
+
+	return nil
+}
+
+// appKey returns the key of an authorized app.
+func appKey(appID string) ([]byte, error) {
+	data, err := loadFile(appKeysFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read app keys: %s", err)
+	}
+
+	var keys map[string]string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("Failed to parse app keys %s: %s", appKeysFile, err)
+	}
+
+	if appID == "" || keys[appID] == "" {
+		return nil, fmt.Errorf("App %s isn't authorized", appID)
+	}
+
+	return []byte(keys[appID]), nil
+}
+
+// SendCommand relays a command signed by an authorized app to a node in the site (including us),
+// returning its reply. Only the master relays commands.
+func (d *NodeDevice) SendCommand(relay *NodeRelay) (*json.RawMessage, error) {
+
+	if relay == nil || !relayedNodeMethods[relay.Method] {
+		return nil, errors.New("Invalid command")
+	}
+
+	if !d.client.state.is(stateMaster) {
+		return nil, errors.New("Only the master relays commands")
+	}
+
+	key, err := appKey(relay.AppID)
+	if err != nil {
+		return nil, fmt.Errorf("Unauthorized sendCommand: %s", err)
+	}
+
+	if err := d.checkSigned("sendCommand", key, relay.Time, relay.Proof, "relay", relay.AppID, relay.Method, relay.Target, strconv.FormatInt(relay.Time, 10)); err != nil {
+		return nil, err
+	}
+
+	log.Infof("Relaying %s from app %s to node %s", relay.Method, relay.AppID, relay.Target)
+
+	var reply json.RawMessage
+	if err := d.client.callNode(relay.Target, relay.Method, &reply); err != nil {
+		return nil, err
+	}
+
+	return &reply, nil
+}
+
+// Reboot reboots the node, shortly after replying.
+func (d *NodeDevice) Reboot(cmd *NodeCommand) error {
+	if err := d.authorize("reboot", cmd); err != nil {
+		return err
+	}
+
+	go func() {
+		time.Sleep(time.Second)
+		reboot()
+	}()
+	return nil
+}
+
+// RestartClient exits, to be restarted by the init system.
+func (d *NodeDevice) RestartClient(cmd *NodeCommand) error {
+	if err := d.authorize("restartClient", cmd); err != nil {
+		return err
+	}
+
+	go func() {
+		time.Sleep(time.Second)
+		log.Infof("Restarting client")
+		os.Exit(0)
+	}()
+	return nil
+}
+
+// Unpair unpairs the node, then restarts the client so it starts pairing again.
+func (d *NodeDevice) Unpair(cmd *NodeCommand) error {
+	if err := d.authorize("unpair", cmd); err != nil {
+		return err
+	}
+
+	go func() {
+		d.client.unpair()
+		d.client.setState(stateUnpaired)
+		d.client.state.wait()
+		log.Infof("Unpaired. Restarting client.")
+		os.Exit(0)
+	}()
+	return nil
+}
+
+// Rediscover searches for peers again.
+func (d *NodeDevice) Rediscover(cmd *NodeCommand) error {
+	if err := d.authorize("rediscover", cmd); err != nil {
+		return err
+	}
+
+	go d.client.findPeers()
+	return nil
+}
+
+// Identify flashes an icon on the LED matrix, so the node can be picked out.
+func (d *NodeDevice) Identify(cmd *NodeCommand) error {
+	if err := d.authorize("identify", cmd); err != nil {
+		return err
+	}
+
+	go d.client.identify()
+	return nil
+}
+
+// GetDiagnostics returns the client's status along with the node's health.
+func (d *NodeDevice) GetDiagnostics(cmd *NodeCommand) (*NodeDiagnostics, error) {
+	if err := d.authorize("getDiagnostics", cmd); err != nil {
+		return nil, err
+	}
+
+	diagnostics := &NodeDiagnostics{
+		Status:  d.client.status(),
+		Peers:   d.client.peers.list(),
+		Version: config.SphereVersion(),
+	}
+
+	diagnostics.Uptime, _ = readUptime()
+	diagnostics.Load, _ = readLoadAverage()
+	diagnostics.Memory, _ = readMemoryUsage()
+	diagnostics.Disk, _ = readDiskUsage(nodeHealthDisk)
+
+	return diagnostics, nil
+}
+
+func (c *client) identify() {
+	err := c.led.Call("disableControl", nil, nil, time.Second*5)
+	if err != nil {
+		log.Warningf("Failed to disable control on LED controller: %s", err)
+	}
+
+	err = c.led.Call("displayIcon", ledmodel.IconRequest{
+		Icon: nodeIdentifyIcon,
+	}, nil, time.Second)
+	if err != nil {
+		log.Warningf("Failed to display identify image on LED controller: %s", err)
+	}
+
+	time.Sleep(nodeIdentifyDuration)
+
+	if c.state.is(stateOrphaned) {
+		c.showOrphaned()
+	} else {
+		c.enableLEDControl()
+	}
+}
+
+// callNode sends a signed command to another node's device. Only works from the master.
+func (c *client) callNode(target, method string, reply interface{}) error {
+
+	key, err := networkKey()
+	if err != nil {
+		return err
+	}
+
+	device := c.conn.GetServiceClient(fmt.Sprintf(nodeDeviceTopic, target, target))
+
+	return device.Call(method, signNodeCommand(key, method, target), reply, defaultTimeout)
+}
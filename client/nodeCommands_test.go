@@ -0,0 +1,71 @@
+package client
+
+import (
+	"io/ioutil"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func signRelay(key []byte, appID, method, target string) *NodeRelay {
+	relay := &NodeRelay{AppID: appID, Target: target, Method: method, Time: time.Now().UnixNano() / int64(time.Millisecond)}
+	relay.Proof = meshMAC(key, "relay", appID, method, target, strconv.FormatInt(relay.Time, 10))
+	return relay
+}
+
+func TestRelayedCommandsMustBeSigned(t *testing.T) {
+	defer withTempFiles(t)()
+
+	networkKey := []byte("network-key")
+	if err := saveCreds(&Credentials{UserID: "user-1", SphereNetworkKey: string(networkKey)}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &NodeDevice{client: &client{state: newStateMachine(stateMaster)}}
+
+	key := []byte("app-key")
+
+	if _, err := d.SendCommand(signRelay(key, "app-1", "reboot", "node-1")); err == nil {
+		t.Fatal("Relayed a command without any authorized apps")
+	}
+
+	if err := ioutil.WriteFile(appKeysFile, []byte(`{"app-1":"app-key"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.SendCommand(signRelay(key, "app-1", "sendCommand", "node-1")); err == nil {
+		t.Fatal("Relayed a method that can't be relayed")
+	}
+
+	if _, err := d.SendCommand(signRelay(key, "app-2", "reboot", "node-1")); err == nil {
+		t.Fatal("Relayed a command from an app that isn't authorized")
+	}
+
+	if _, err := d.SendCommand(signRelay([]byte("wrong-key"), "app-1", "reboot", "node-1")); err == nil {
+		t.Fatal("Relayed a command signed with the wrong key")
+	}
+
+	if _, err := d.SendCommand(signRelay(networkKey, "app-1", "reboot", "node-1")); err == nil {
+		t.Fatal("Relayed a command signed with the network key")
+	}
+
+	stale := signRelay(key, "app-1", "reboot", "node-1")
+	stale.Time -= int64((nodeCommandWindow * 2) / time.Millisecond)
+	stale.Proof = meshMAC(key, "relay", stale.AppID, stale.Method, stale.Target, strconv.FormatInt(stale.Time, 10))
+	if _, err := d.SendCommand(stale); err == nil {
+		t.Fatal("Relayed a stale command")
+	}
+
+	relay := signRelay(key, "app-1", "reboot", "node-1")
+	if err := d.checkSigned("sendCommand", key, relay.Time, relay.Proof, "relay", relay.AppID, relay.Method, relay.Target, strconv.FormatInt(relay.Time, 10)); err != nil {
+		t.Fatalf("Rejected a signed command: %s", err)
+	}
+	if _, err := d.SendCommand(relay); err == nil {
+		t.Fatal("Relayed a replayed command")
+	}
+
+	slave := &NodeDevice{client: &client{state: newStateMachine(stateSlaveBridged)}}
+	if _, err := slave.SendCommand(signRelay(key, "app-1", "reboot", "node-1")); err == nil {
+		t.Fatal("A slave relayed a command")
+	}
+}
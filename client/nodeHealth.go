@@ -0,0 +1,255 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+// How often the node device's health channels are updated.
+var nodeHealthInterval = config.Duration(time.Minute, "client", "health", "interval")
+
+var nodeHealthDisk = config.String("/data", "client", "health", "disk")
+var nodeHealthThermalZone = config.String("/sys/class/thermal/thermal_zone0/temp", "client", "health", "thermalZone")
+
+// The health channels exported on the node device. Each uses the protocol /protocol/node/<id>.
+var nodeHealthChannels = []string{"status", "uptime", "load", "memory", "disk", "temperature", "role", "bridge"}
+
+// healthChannel is a read-only channel on the node device, whose state is sent periodically.
+type healthChannel struct {
+	mu        sync.Mutex
+	id        string
+	sendEvent func(event string, payload interface{}) error
+}
+
+func (c *healthChannel) GetProtocol() string {
+	return "/protocol/node/" + c.id
+}
+
+func (c *healthChannel) SetEventHandler(sendEvent func(event string, payload interface{}) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sendEvent = sendEvent
+}
+
+func (c *healthChannel) SendState(state interface{}) error {
+	c.mu.Lock()
+	sendEvent := c.sendEvent
+	c.mu.Unlock()
+
+	if sendEvent == nil {
+		return fmt.Errorf("Channel %s has not been exported", c.id)
+	}
+	return sendEvent("state", state)
+}
+
+// nodeStatus is the state of the status channel, saying whether the node is part of the mesh.
+type nodeStatus struct {
+	State        string `json:"state"`
+	Master       bool   `json:"master"`
+	MasterNodeID string `json:"masterNodeId"`
+	Bridged      bool   `json:"bridged"`
+	Orphaned     bool   `json:"orphaned"`
+}
+
+type loadAverage struct {
+	One     float64 `json:"1m"`
+	Five    float64 `json:"5m"`
+	Fifteen float64 `json:"15m"`
+}
+
+type memoryUsage struct {
+	Total     uint64 `json:"total"`
+	Available uint64 `json:"available"`
+}
+
+type diskUsage struct {
+	Path  string `json:"path"`
+	Total uint64 `json:"total"`
+	Free  uint64 `json:"free"`
+}
+
+// publishNodeHealth periodically sends the state of each health channel on the node device, once
+// it has been exported.
+func (c *client) publishNodeHealth() {
+	for {
+		if c.nodeDevice.exported() {
+			c.sendNodeHealth(c.nodeDevice)
+		}
+
+		time.Sleep(nodeHealthInterval)
+	}
+}
+
+// sendNodeStatus updates the status channel, if the node device has been exported.
+func (c *client) sendNodeStatus() {
+	if !c.nodeDevice.exported() {
+		return
+	}
+
+	for _, channel := range c.nodeDevice.channels {
+		if channel.id == "status" {
+			if err := channel.SendState(c.nodeStatus()); err != nil {
+				log.Warningf("Failed to send node status: %s", err)
+			}
+		}
+	}
+}
+
+func (c *client) nodeStatus() *nodeStatus {
+	return &nodeStatus{
+		State:        string(c.state.current()),
+		Master:       c.state.is(stateMaster),
+		MasterNodeID: config.String("", "masterNodeId"),
+		Bridged:      c.state.is(stateSlaveBridged),
+		Orphaned:     c.state.is(stateOrphaned),
+	}
+}
+
+func (c *client) sendNodeHealth(nodeDevice *NodeDevice) {
+
+	bridge := c.bridgeHealth()
+	if bridge == nil {
+		bridge = &meshBridgeHealth{}
+	}
+
+	readings := map[string]func() (interface{}, error){
+		"uptime":      func() (interface{}, error) { return readUptime() },
+		"load":        func() (interface{}, error) { return readLoadAverage() },
+		"memory":      func() (interface{}, error) { return readMemoryUsage() },
+		"disk":        func() (interface{}, error) { return readDiskUsage(nodeHealthDisk) },
+		"temperature": func() (interface{}, error) { return readTemperature(nodeHealthThermalZone) },
+		"status":      func() (interface{}, error) { return c.nodeStatus(), nil },
+		"role":        func() (interface{}, error) { return string(c.state.current()), nil },
+		"bridge":      func() (interface{}, error) { return bridge, nil },
+	}
+
+	for _, channel := range nodeDevice.channels {
+		read, ok := readings[channel.id]
+		if !ok {
+			continue
+		}
+
+		state, err := read()
+		if err != nil {
+			log.Debugf("Failed to read node health %s: %s", channel.id, err)
+			continue
+		}
+
+		if err := channel.SendState(state); err != nil {
+			log.Warningf("Failed to send node health %s: %s", channel.id, err)
+		}
+	}
+}
+
+// readUptime returns the seconds since boot.
+func readUptime() (float64, error) {
+	data, err := ioutil.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("Invalid /proc/uptime: %s", data)
+	}
+
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+func readLoadAverage() (*loadAverage, error) {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("Invalid /proc/loadavg: %s", data)
+	}
+
+	var load [3]float64
+	for i := range load {
+		if load[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return nil, err
+		}
+	}
+
+	return &loadAverage{load[0], load[1], load[2]}, nil
+}
+
+func readMemoryUsage() (*memoryUsage, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := make(map[string]uint64)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// e.g. "MemTotal:        1025512 kB"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[strings.TrimSuffix(fields[0], ":")] = kb * 1024
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	usage := &memoryUsage{
+		Total:     values["MemTotal"],
+		Available: values["MemAvailable"],
+	}
+
+	// Older kernels don't have MemAvailable
+	if _, ok := values["MemAvailable"]; !ok {
+		usage.Available = values["MemFree"] + values["Buffers"] + values["Cached"]
+	}
+
+	return usage, nil
+}
+
+func readDiskUsage(path string) (*diskUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return nil, err
+	}
+
+	return &diskUsage{
+		Path:  path,
+		Total: uint64(stat.Blocks) * uint64(stat.Bsize),
+		Free:  uint64(stat.Bavail) * uint64(stat.Bsize),
+	}, nil
+}
+
+// readTemperature returns the CPU temperature in degrees celsius.
+func readTemperature(zone string) (float64, error) {
+	data, err := ioutil.ReadFile(zone)
+	if err != nil {
+		return 0, err
+	}
+
+	milli, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return milli / 1000, nil
+}
@@ -0,0 +1,287 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/mdns"
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+// How long a no-cloud node without any mesh info looks for a master to join before becoming the
+// master of a new site itself.
+var offlineDiscoveryTime = config.Duration(time.Second*30, "client", "offline", "discoveryTime")
+
+// Nodes that boot together would all become the master of their own site. After a random hold-off
+// of up to this long, only the one with the lowest id does. The others join it.
+var offlineHoldOff = config.Duration(time.Second*20, "client", "offline", "holdOff")
+
+// Advertised by unpaired no-cloud nodes, which are bootstrapping a site. Unpaired nodes with a cloud
+// advertise the same service, but are waiting to be paired, so mustn't hold up the bootstrap.
+const offlineBootstrapTXT = "ninja.sphere.bootstrap=offline"
+
+// advertisedMaster is a master node found on the LAN.
+type advertisedMaster struct {
+	ID          string
+	UserID      string
+	SiteID      string
+	SiteUpdated int
+	PairingPort int
+	Info        map[string]string
+	Entry       *mdns.ServiceEntry
+}
+
+// bootstrapOffline creates the mesh info (and credentials) for a node with no cloud. If a master
+// can be found on the LAN we join its site, otherwise the node with the lowest id of those
+// bootstrapping becomes the master of a new one. Discovery is retried until one of those happens.
+func (c *client) bootstrapOffline() error {
+
+	log.Infof("No cloud and no mesh information. Looking for a master to join for %s.", offlineDiscoveryTime)
+
+	for {
+		master, err := findMaster(offlineDiscoveryTime)
+		if err != nil {
+			log.Warningf("%s. Trying again.", err)
+			time.Sleep(offlineHoldOff)
+			continue
+		}
+
+		if master != nil {
+			err := c.joinOfflineMaster(master)
+			if err == nil {
+				return nil
+			}
+
+			log.Warningf("Failed to join master %s. Looking again. error: %s", master.ID, err)
+			continue
+		}
+
+		time.Sleep(time.Duration(mathrand.Int63n(int64(offlineHoldOff) + 1)))
+
+		others, err := findBootstrappingNodes(time.Second * 5)
+		if err != nil {
+			log.Warningf("%s. Trying again.", err)
+			continue
+		}
+
+		lowest := config.Serial()
+		for _, id := range others {
+			if id < lowest {
+				lowest = id
+			}
+		}
+
+		if lowest == config.Serial() {
+			return createOfflineSite()
+		}
+
+		log.Infof("Node %s is also looking for a master, and has a lower id. Waiting for it to become the master.", lowest)
+	}
+}
+
+// findBootstrappingNodes returns the ids of the other no-cloud nodes on the LAN that are
+// bootstrapping a site.
+func findBootstrappingNodes(timeout time.Duration) ([]string, error) {
+
+	query := "_ninja-setup-assistant-rest._tcp"
+
+	entriesCh := make(chan *mdns.ServiceEntry, 4)
+	found := make(chan []string, 1)
+
+	go func() {
+		seen := make(map[string]bool)
+		var ids []string
+
+		for entry := range entriesCh {
+			if !strings.Contains(entry.Name, query) {
+				continue
+			}
+
+			info := parseMdnsInfo(entry.Info)
+			if info["ninja.sphere.bootstrap"] != "offline" {
+				continue
+			}
+
+			id := info["ninja.sphere.node_id"]
+			if id != "" && id != config.Serial() && !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+
+		found <- ids
+	}()
+
+	params := mdns.DefaultParams(query)
+	params.Entries = entriesCh
+	params.Timeout = timeout
+
+	err := mdns.Query(params)
+	close(entriesCh)
+
+	ids := <-found
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to look for other nodes: %s", err)
+	}
+
+	return ids, nil
+}
+
+// findMaster looks for a master node (owned by our user, if we have one) on the LAN.
+func findMaster(timeout time.Duration) (*advertisedMaster, error) {
+
+	query := "_ninja-homecloud-mqtt._tcp"
+
+	entriesCh := make(chan *mdns.ServiceEntry, 4)
+	found := make(chan *advertisedMaster, 1)
+
+	go func() {
+		var master *advertisedMaster
+
+		for entry := range entriesCh {
+			if master != nil || !strings.Contains(entry.Name, query) {
+				continue
+			}
+
+			nodeInfo := parseMdnsInfo(entry.Info)
+
+			if nodeInfo["ninja.sphere.master"] != "true" || nodeInfo["ninja.sphere.node_id"] == config.Serial() {
+				continue
+			}
+
+			user := nodeInfo["ninja.sphere.user_id"]
+			if config.HasString("userId") && user != config.MustString("userId") {
+				log.Infof("Found a master owned by another user (%s) - %s", user, entry.Addr)
+				continue
+			}
+
+			siteUpdated, _ := strconv.Atoi(nodeInfo["ninja.sphere.site_updated"])
+			pairingPort, _ := strconv.Atoi(nodeInfo["ninja.sphere.pairing_port"])
+
+			master = &advertisedMaster{
+				ID:          nodeInfo["ninja.sphere.node_id"],
+				UserID:      user,
+				SiteID:      nodeInfo["ninja.sphere.site_id"],
+				SiteUpdated: siteUpdated,
+				PairingPort: pairingPort,
+				Info:        nodeInfo,
+				Entry:       entry,
+			}
+		}
+
+		found <- master
+	}()
+
+	params := mdns.DefaultParams(query)
+	params.Entries = entriesCh
+	params.Timeout = timeout
+
+	err := mdns.Query(params)
+	close(entriesCh)
+
+	master := <-found
+
+	if err != nil && master == nil {
+		return nil, fmt.Errorf("Failed to look for a master: %s", err)
+	}
+
+	return master, nil
+}
+
+// joinOfflineMaster asks the master to let us join its site. If we already have the network key,
+// a master whose mDNS records are signed with it can be joined without asking.
+func (c *client) joinOfflineMaster(master *advertisedMaster) error {
+
+	log.Infof("Joining site %s with master %s - %s", master.SiteID, master.ID, master.Entry.Addr)
+
+	if key, err := networkKey(); err == nil && verifyMeshTXT(key, master.Info) {
+		if master.SiteID == "" {
+			return fmt.Errorf("Master %s isn't advertising a site", master.ID)
+		}
+
+		return saveMeshInfo(&meshInfo{
+			SiteID:       master.SiteID,
+			MasterNodeID: master.ID,
+			SiteUpdated:  master.SiteUpdated,
+		})
+	}
+
+	if master.PairingPort == 0 {
+		return fmt.Errorf("Can't join master %s, as it doesn't accept join requests", master.ID)
+	}
+
+	var grant *joinGrant
+	err := c.retry(localPairingRetry, func() error {
+		var err error
+		grant, err = c.requestJoin(master, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return saveJoinGrant(grant)
+}
+
+// createOfflineSite makes us the master of a new site. If we already have credentials (i.e. we
+// were paired through the cloud, and are only offline) they are kept, otherwise a local user and
+// sphere network key are generated.
+func createOfflineSite() error {
+
+	siteID, err := randomID()
+	if err != nil {
+		return err
+	}
+
+	creds, err := loadCreds()
+
+	if err == nil {
+		if creds.UserID == "" || creds.SphereNetworkKey == "" {
+			return fmt.Errorf("Refusing to replace incomplete credentials in %s with an offline site", credsFile)
+		}
+
+		log.Infof("No master found. Creating site %s for user %s, with this node as the master.", siteID, creds.UserID)
+	} else {
+		creds = &Credentials{
+			UserID: config.String("", "userId"),
+		}
+
+		if creds.UserID == "" {
+			userID, err := randomID()
+			if err != nil {
+				return err
+			}
+			creds.UserID = "local-" + userID
+		}
+
+		if creds.SphereNetworkKey, err = randomID(); err != nil {
+			return err
+		}
+
+		log.Infof("No master found. Creating site %s for user %s, with this node as the master.", siteID, creds.UserID)
+
+		if err := saveCreds(creds); err != nil {
+			return err
+		}
+	}
+
+	return saveMeshInfo(&meshInfo{
+		SiteID:       siteID,
+		MasterNodeID: config.Serial(),
+		SiteUpdated:  int(time.Now().Unix()),
+	})
+}
+
+func randomID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,229 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+// Peers that haven't been seen for this long are dropped from the registry.
+var peerExpiry = config.Duration(time.Minute*3, "client", "peers", "expiry")
+
+// When peers that have left were last seen is remembered for this long.
+var peerForget = config.Duration(time.Hour, "client", "peers", "forget")
+
+// How often the round trip time to each peer is measured, and how long to wait for it.
+var peerRTTInterval = config.Duration(time.Minute, "client", "peers", "rttInterval")
+var peerRTTTimeout = config.Duration(time.Second*2, "client", "peers", "rttTimeout")
+
+type peerInfo struct {
+	ID           string    `json:"id"`
+	UserID       string    `json:"userId"`
+	SiteID       string    `json:"siteId"`
+	Master       bool      `json:"master"`
+	MasterNodeID string    `json:"masterNodeId"`
+	SiteUpdated  string    `json:"siteUpdated"`
+	Address      string    `json:"address"`
+	Port         int       `json:"port"`
+	LastSeen     time.Time `json:"lastSeen"`
+	FirstSeen    time.Time `json:"firstSeen"`
+	RTT          float64   `json:"rtt,omitempty"` // ms
+	rttMeasured  time.Time
+}
+
+// peerRegistry keeps every node discovered on the LAN until it hasn't been seen for the expiry
+// time. Hooks are called when a node is first seen, and when it expires.
+type peerRegistry struct {
+	mu       sync.Mutex
+	peers    map[string]*peerInfo
+	departed map[string]time.Time
+	expiry   time.Duration
+	onJoin   func(peerInfo)
+	onLeave  func(peerInfo)
+}
+
+func newPeerRegistry(expiry time.Duration, onJoin, onLeave func(peerInfo)) *peerRegistry {
+	return &peerRegistry{
+		peers:    make(map[string]*peerInfo),
+		departed: make(map[string]time.Time),
+		expiry:   expiry,
+		onJoin:   onJoin,
+		onLeave:  onLeave,
+	}
+}
+
+// start expires peers in the background.
+func (r *peerRegistry) start() {
+	go func() {
+		for range time.Tick(r.expiry / 6) {
+			r.expire()
+		}
+	}()
+}
+
+// update records that a peer has just been seen, returning whether it is new.
+func (r *peerRegistry) update(peer peerInfo) bool {
+	r.mu.Lock()
+
+	existing, known := r.peers[peer.ID]
+	if known {
+		peer.FirstSeen = existing.FirstSeen
+		peer.RTT = existing.RTT
+		peer.rttMeasured = existing.rttMeasured
+	} else {
+		peer.FirstSeen = peer.LastSeen
+		delete(r.departed, peer.ID)
+	}
+
+	measure := time.Since(peer.rttMeasured) > peerRTTInterval
+	if measure {
+		// Stops another measurement starting before this one finishes
+		peer.rttMeasured = time.Now()
+	}
+
+	r.peers[peer.ID] = &peer
+	r.mu.Unlock()
+
+	if !known && r.onJoin != nil {
+		r.onJoin(peer)
+	}
+
+	if measure {
+		go r.measureRTT(peer.ID, peer.Address, peer.Port)
+	}
+
+	return !known
+}
+
+// measureRTT times a tcp connection to the peer's advertised port.
+func (r *peerRegistry) measureRTT(id, address string, port int) {
+	start := time.Now()
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, fmt.Sprintf("%d", port)), peerRTTTimeout)
+	if err != nil {
+		log.Debugf("Failed to measure round trip time to peer %s: %s", id, err)
+		return
+	}
+	conn.Close()
+
+	rtt := float64(time.Since(start)) / float64(time.Millisecond)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if peer, ok := r.peers[id]; ok {
+		peer.RTT = rtt
+	}
+}
+
+func (r *peerRegistry) expire() {
+	r.mu.Lock()
+
+	var left []peerInfo
+	for id, peer := range r.peers {
+		if time.Since(peer.LastSeen) > r.expiry {
+			delete(r.peers, id)
+			r.departed[id] = peer.LastSeen
+			left = append(left, *peer)
+		}
+	}
+
+	for id, lastSeen := range r.departed {
+		if time.Since(lastSeen) > peerForget {
+			delete(r.departed, id)
+		}
+	}
+
+	r.mu.Unlock()
+
+	if r.onLeave != nil {
+		for _, peer := range left {
+			r.onLeave(peer)
+		}
+	}
+}
+
+// remove drops a peer straight away, e.g. when it has said goodbye.
+func (r *peerRegistry) remove(id string) {
+	r.mu.Lock()
+	peer, ok := r.peers[id]
+	if ok {
+		delete(r.peers, id)
+		r.departed[id] = peer.LastSeen
+	}
+	r.mu.Unlock()
+
+	if ok && r.onLeave != nil {
+		r.onLeave(*peer)
+	}
+}
+
+// get returns a peer, if it hasn't expired.
+func (r *peerRegistry) get(id string) (peerInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	peer, ok := r.peers[id]
+	if !ok {
+		return peerInfo{}, false
+	}
+	return *peer, true
+}
+
+// list returns the current peers, sorted by id.
+func (r *peerRegistry) list() []peerInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	peers := []peerInfo{}
+	for _, peer := range r.peers {
+		peers = append(peers, *peer)
+	}
+
+	sort.Sort(peersByID(peers))
+	return peers
+}
+
+// lastSeen returns when a peer was last seen, even if it has since expired.
+func (r *peerRegistry) lastSeen(id string) time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if peer, ok := r.peers[id]; ok {
+		return peer.LastSeen
+	}
+	return r.departed[id]
+}
+
+// fresh returns whether a peer has been seen within the given time.
+func (r *peerRegistry) fresh(id string, within time.Duration) bool {
+	seen := r.lastSeen(id)
+	return !seen.IsZero() && time.Since(seen) < within
+}
+
+type peersByID []peerInfo
+
+func (p peersByID) Len() int           { return len(p) }
+func (p peersByID) Less(i, j int) bool { return p[i].ID < p[j].ID }
+func (p peersByID) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// onPeerJoin and onPeerLeave publish on $node/<serial>/client/peers/join and .../leave. A slave is
+// orphaned when the master leaves.
+func (c *client) onPeerJoin(peer peerInfo) {
+	log.Infof("Peer %s joined (%s)", peer.ID, peer.Address)
+	c.conn.PublishRaw(fmt.Sprintf("$node/%s/client/peers/join", config.Serial()), peer)
+}
+
+func (c *client) onPeerLeave(peer peerInfo) {
+	log.Infof("Peer %s left (last seen %s)", peer.ID, peer.LastSeen)
+	c.conn.PublishRaw(fmt.Sprintf("$node/%s/client/peers/leave", config.Serial()), peer)
+
+	if peer.ID == config.String("", "masterNodeId") && c.state.is(stateSlaveSearching, stateSlaveBridged) {
+		log.Infof("The master has left")
+		c.setOrphaned()
+	}
+}
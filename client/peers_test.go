@@ -0,0 +1,56 @@
+package client
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPeerRegistryExpiry(t *testing.T) {
+	var lock sync.Mutex
+	var joined, left []string
+
+	r := newPeerRegistry(time.Minute, func(peer peerInfo) {
+		lock.Lock()
+		joined = append(joined, peer.ID)
+		lock.Unlock()
+	}, func(peer peerInfo) {
+		lock.Lock()
+		left = append(left, peer.ID)
+		lock.Unlock()
+	})
+
+	seen := time.Now().Add(-time.Minute * 2)
+	if !r.update(peerInfo{ID: "master-1", Address: "127.0.0.1", Port: 1, LastSeen: seen}) {
+		t.Fatal("Expected a new peer")
+	}
+	if r.update(peerInfo{ID: "master-1", Address: "127.0.0.1", Port: 1, LastSeen: seen}) {
+		t.Fatal("Expected a known peer")
+	}
+
+	r.expire()
+
+	lock.Lock()
+	if len(joined) != 1 || len(left) != 1 || left[0] != "master-1" {
+		t.Fatalf("Expected master-1 to join and leave once, got %v %v", joined, left)
+	}
+	lock.Unlock()
+
+	if _, ok := r.get("master-1"); ok {
+		t.Fatal("Expired peer is still listed")
+	}
+	if !r.lastSeen("master-1").Equal(seen) {
+		t.Fatal("Expected to remember when the departed peer was last seen")
+	}
+
+	// Long gone peers are forgotten
+	r.mu.Lock()
+	r.departed["master-1"] = time.Now().Add(-peerForget * 2)
+	r.mu.Unlock()
+
+	r.expire()
+
+	if !r.lastSeen("master-1").IsZero() {
+		t.Fatal("Departed peer was never forgotten")
+	}
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const backupSuffix = ".bak"
+
+// saveFile atomically replaces filename with data (which must be valid JSON). The previous copy,
+// if it was valid, is kept in filename.bak so loadFile has something to fall back to.
+func saveFile(filename string, data []byte, perm os.FileMode) error {
+
+	if !json.Valid(data) {
+		return fmt.Errorf("Refusing to save invalid JSON to %s", filename)
+	}
+
+	if existing, err := ioutil.ReadFile(filename); err == nil && json.Valid(existing) {
+		if err := writeFileAtomic(filename+backupSuffix, existing, perm); err != nil {
+			log.Warningf("Failed to back up %s: %s", filename, err)
+		}
+	}
+
+	return writeFileAtomic(filename, data, perm)
+}
+
+// loadFile reads filename, checking that it is valid JSON. If it exists but isn't valid, the backup
+// is used instead and restored over the broken file. A missing file is just missing, as it may
+// have been deleted on purpose.
+func loadFile(filename string) ([]byte, error) {
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if json.Valid(data) {
+		return data, nil
+	}
+
+	err = fmt.Errorf("%s is not valid JSON", filename)
+
+	backup, backupErr := ioutil.ReadFile(filename + backupSuffix)
+	if backupErr != nil || !json.Valid(backup) {
+		return nil, err
+	}
+
+	log.Warningf("Failed to load %s (%s). Restoring the backup.", filename, err)
+
+	perm := os.FileMode(0600)
+	if info, err := os.Stat(filename + backupSuffix); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	if err := writeFileAtomic(filename, backup, perm); err != nil {
+		log.Warningf("Failed to restore %s from backup: %s", filename, err)
+	}
+
+	return backup, nil
+}
+
+// restoreFiles makes sure each of the files that exists is valid, restoring backups where needed.
+// It returns true if anything was restored (and so the config needs refreshing).
+func restoreFiles(filenames ...string) bool {
+	restored := false
+
+	for _, filename := range filenames {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil || json.Valid(data) {
+			continue
+		}
+		if _, err := loadFile(filename); err == nil {
+			restored = true
+		}
+	}
+
+	return restored
+}
+
+// removeFile deletes filename along with its backup, so it isn't restored later.
+func removeFile(filename string) error {
+	for _, f := range []string{filename, filename + backupSuffix} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temp file next to filename, syncs it and renames it into
+// place (syncing the directory too), so a power loss leaves either the old or the new file, never
+// a truncated one.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+
+	dir := filepath.Dir(filename)
+
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+
+	tmp := f.Name()
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
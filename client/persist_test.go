@@ -0,0 +1,85 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "sphere-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "file.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestLoadFileRestoresCorruptFile(t *testing.T) {
+	filename, cleanup := tempFile(t)
+	defer cleanup()
+
+	if err := saveFile(filename, []byte(`{"a":1}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveFile(filename, []byte(`{"a":2}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Truncated by a power loss
+	if err := ioutil.WriteFile(filename, []byte(`{"a":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if !restoreFiles(filename) {
+		t.Fatal("Expected the corrupt file to be restored")
+	}
+
+	data, err := loadFile(filename)
+	if err != nil || string(data) != `{"a":1}` {
+		t.Fatalf("Expected the backup, got %s %v", data, err)
+	}
+}
+
+func TestLoadFileIgnoresBackupOfMissingFile(t *testing.T) {
+	filename, cleanup := tempFile(t)
+	defer cleanup()
+
+	if err := saveFile(filename, []byte(`{"a":1}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveFile(filename, []byte(`{"a":2}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleted by something else, leaving the backup behind
+	if err := os.Remove(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if restoreFiles(filename) {
+		t.Fatal("A missing file shouldn't be restored")
+	}
+
+	if _, err := loadFile(filename); !os.IsNotExist(err) {
+		t.Fatalf("Expected the file to be missing, got %v", err)
+	}
+}
+
+func TestRemoveFileRemovesBackup(t *testing.T) {
+	filename, cleanup := tempFile(t)
+	defer cleanup()
+
+	saveFile(filename, []byte(`{"a":1}`), 0600)
+	saveFile(filename, []byte(`{"a":2}`), 0600)
+
+	if err := removeFile(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []string{filename, filename + backupSuffix} {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be removed", f)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/api"
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+const siteModelService = "SiteModel"
+
+// How often services are probed while they aren't ready, and once they are.
+var readinessInterval = config.Duration(time.Second*2, "client", "readiness", "interval")
+var readinessReadyInterval = config.Duration(time.Second*30, "client", "readiness", "readyInterval")
+var readinessCallTimeout = config.Duration(time.Second*5, "client", "readiness", "callTimeout")
+
+// readinessProbe checks a HomeCloud service is up by calling a cheap method on it.
+type readinessProbe struct {
+	Name   string
+	Method string
+	Args   func() interface{}
+}
+
+// Only services something waits on are probed. ThingModel has no cheap method, and nothing needs
+// it, so it isn't.
+var readinessProbes = []readinessProbe{
+	{
+		Name:   siteModelService,
+		Method: "fetch",
+		Args:   func() interface{} { return config.MustString("siteId") },
+	},
+}
+
+// readinessStatus is published on $node/<serial>/client/readiness whenever a service becomes
+// ready or stops being ready.
+type readinessStatus struct {
+	Ready    bool            `json:"ready"`
+	Services map[string]bool `json:"services"`
+}
+
+// readiness tracks which of the HomeCloud services on the bus are answering calls, so client
+// features that need them can wait until they are.
+type readiness struct {
+	sync.Mutex
+	conn    *ninja.Connection
+	probes  []readinessProbe
+	ready   map[string]bool
+	changed chan struct{}
+	hooks   []func(service string, ready bool)
+}
+
+func newReadiness(conn *ninja.Connection, probes []readinessProbe) *readiness {
+	r := &readiness{
+		conn:    conn,
+		probes:  probes,
+		ready:   make(map[string]bool),
+		changed: make(chan struct{}),
+	}
+
+	for _, probe := range probes {
+		r.ready[probe.Name] = false
+	}
+
+	return r
+}
+
+// onChange registers a hook called whenever a service becomes ready or stops being ready.
+func (r *readiness) onChange(hook func(service string, ready bool)) {
+	r.Lock()
+	defer r.Unlock()
+	r.hooks = append(r.hooks, hook)
+}
+
+func (r *readiness) start() {
+	for _, probe := range r.probes {
+		go r.watch(probe)
+	}
+}
+
+func (r *readiness) watch(probe readinessProbe) {
+
+	service := r.conn.GetServiceClient("$home/services/" + probe.Name)
+
+	for {
+		err := service.Call(probe.Method, probe.Args(), nil, readinessCallTimeout)
+		if err != nil {
+			log.Debugf("%s isn't ready: %s", probe.Name, err)
+		}
+
+		ready := err == nil
+		r.set(probe.Name, ready)
+
+		if ready {
+			time.Sleep(readinessReadyInterval)
+		} else {
+			time.Sleep(readinessInterval)
+		}
+	}
+}
+
+func (r *readiness) set(name string, ready bool) {
+	r.Lock()
+
+	if r.ready[name] == ready {
+		r.Unlock()
+		return
+	}
+
+	r.ready[name] = ready
+
+	close(r.changed)
+	r.changed = make(chan struct{})
+
+	status := r.status()
+	hooks := append([]func(string, bool){}, r.hooks...)
+	r.Unlock()
+
+	log.Infof("Service %s ready: %t", name, ready)
+
+	r.conn.PublishRaw(fmt.Sprintf("$node/%s/client/readiness", config.Serial()), status)
+
+	for _, hook := range hooks {
+		hook(name, ready)
+	}
+}
+
+// status must be called with the lock held.
+func (r *readiness) status() *readinessStatus {
+	status := &readinessStatus{
+		Ready:    true,
+		Services: make(map[string]bool),
+	}
+
+	for name, ready := range r.ready {
+		status.Services[name] = ready
+		if !ready {
+			status.Ready = false
+		}
+	}
+
+	return status
+}
+
+func (r *readiness) getStatus() *readinessStatus {
+	r.Lock()
+	defer r.Unlock()
+	return r.status()
+}
+
+// notReady returns the named services (or all of them, if none are named) that aren't ready,
+// along with a channel that is closed the next time that changes.
+func (r *readiness) notReady(names []string) ([]string, chan struct{}) {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(names) == 0 {
+		for name := range r.ready {
+			names = append(names, name)
+		}
+	}
+
+	var waiting []string
+	for _, name := range names {
+		if !r.ready[name] {
+			waiting = append(waiting, name)
+		}
+	}
+	sort.Strings(waiting)
+
+	return waiting, r.changed
+}
+
+// wait blocks until the named services (or all of them, if none are named) are ready. A timeout
+// of 0 waits forever.
+func (r *readiness) wait(timeout time.Duration, names ...string) error {
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+
+	for {
+		waiting, changed := r.notReady(names)
+		if len(waiting) == 0 {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-expired:
+			return fmt.Errorf("Timed out after %s waiting for %s", timeout, strings.Join(waiting, ", "))
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// errRetryNow can be returned from a retried operation to have it called again straight away,
+// without it counting as a failure (i.e. a long-poll that timed out).
+var errRetryNow = errors.New("Retry now")
+
+// permanentError wraps an error that should stop an operation from being retried.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// retryPolicy describes how an operation talking to something unreliable (the cloud, HomeCloud)
+// is retried. The interval grows exponentially from Initial up to Max, with a random Jitter
+// (a fraction of the interval) applied so a fleet of nodes doesn't retry in lock-step.
+//
+// If BreakerThreshold is set, that many consecutive failures open the circuit breaker, and the
+// operation isn't tried again until BreakerCooldown has passed. If Deadline is set, we give up
+// once it has passed since the first attempt.
+type retryPolicy struct {
+	Name             string
+	Initial          time.Duration
+	Max              time.Duration
+	Multiplier       float64
+	Jitter           float64
+	Deadline         time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// retryState is published on $node/<serial>/client/retry each time an operation fails.
+type retryState struct {
+	Operation   string `json:"operation"`
+	Attempt     int    `json:"attempt"`
+	Error       string `json:"error"`
+	NextAttempt int64  `json:"nextAttempt"`
+	BreakerOpen bool   `json:"breakerOpen"`
+	GaveUp      bool   `json:"gaveUp"`
+}
+
+// loadRetryPolicy returns the defaults, overridden by anything set under client.retry.<name>
+// (initial, max, multiplier, jitterPercent, deadline, breakerThreshold, breakerCooldown).
+func loadRetryPolicy(name string, defaults retryPolicy) *retryPolicy {
+	key := func(k string) []string {
+		return []string{"client", "retry", name, k}
+	}
+
+	return &retryPolicy{
+		Name:             name,
+		Initial:          config.Duration(defaults.Initial, key("initial")...),
+		Max:              config.Duration(defaults.Max, key("max")...),
+		Multiplier:       config.Float(defaults.Multiplier, key("multiplier")...),
+		Jitter:           float64(config.Int(int(defaults.Jitter*100), key("jitterPercent")...)) / 100,
+		Deadline:         config.Duration(defaults.Deadline, key("deadline")...),
+		BreakerThreshold: config.Int(defaults.BreakerThreshold, key("breakerThreshold")...),
+		BreakerCooldown:  config.Duration(defaults.BreakerCooldown, key("breakerCooldown")...),
+	}
+}
+
+var (
+	activationRetry = loadRetryPolicy("activation", retryPolicy{
+		Initial:          time.Second * 3,
+		Max:              time.Minute * 5,
+		Multiplier:       2,
+		Jitter:           0.5,
+		BreakerThreshold: 10,
+		BreakerCooldown:  time.Minute * 15,
+	})
+	meshRetry = loadRetryPolicy("mesh", retryPolicy{
+		Initial:    time.Second * 2,
+		Max:        time.Second * 15,
+		Multiplier: 2,
+		Jitter:     0.3,
+		Deadline:   time.Second * 30,
+	})
+	exportRetry = loadRetryPolicy("export", retryPolicy{
+		Initial:    time.Second * 5,
+		Max:        time.Minute,
+		Multiplier: 2,
+		Jitter:     0.3,
+	})
+)
+
+// interval returns how long to wait before the given (1-based) attempt is retried.
+func (p *retryPolicy) interval(attempt int) time.Duration {
+	interval := float64(p.Initial)
+	for i := 1; i < attempt && interval < float64(p.Max); i++ {
+		interval *= p.Multiplier
+	}
+
+	if p.Max > 0 && interval > float64(p.Max) {
+		interval = float64(p.Max)
+	}
+
+	return p.jitter(time.Duration(interval))
+}
+
+// jitter randomly moves a wait by up to Jitter of it, either way.
+func (p *retryPolicy) jitter(wait time.Duration) time.Duration {
+	if p.Jitter <= 0 {
+		return wait
+	}
+	return wait + time.Duration(float64(wait)*p.Jitter*(rand.Float64()*2-1))
+}
+
+// run calls op until it succeeds, returns a permanent error, or the deadline passes. Each failure
+// is passed to notify (if not nil).
+func (p *retryPolicy) run(op func() error, notify func(retryState)) error {
+
+	started := time.Now()
+	attempt := 0
+	failures := 0
+
+	for {
+		err := op()
+
+		if err == nil {
+			return nil
+		}
+
+		if err == errRetryNow {
+			attempt = 0
+			failures = 0
+			continue
+		}
+
+		if perm, ok := err.(permanentError); ok {
+			return perm.err
+		}
+
+		attempt++
+		failures++
+
+		wait := p.interval(attempt)
+		state := retryState{
+			Operation: p.Name,
+			Attempt:   attempt,
+			Error:     err.Error(),
+		}
+
+		if p.BreakerThreshold > 0 && failures >= p.BreakerThreshold {
+			// Jittered too, or a fleet that failed together (e.g. after a power cut) retries together.
+			wait = p.jitter(p.BreakerCooldown)
+			// Half-open. One more failure after the cooldown opens it again.
+			failures = p.BreakerThreshold - 1
+			state.BreakerOpen = true
+		}
+
+		if p.Deadline > 0 && time.Since(started)+wait > p.Deadline {
+			state.GaveUp = true
+			log.Warningf("Giving up on %s after %d attempts: %s", p.Name, attempt, err)
+			if notify != nil {
+				notify(state)
+			}
+			return fmt.Errorf("Gave up on %s after %d attempts: %s", p.Name, attempt, err)
+		}
+
+		state.NextAttempt = time.Now().Add(wait).UnixNano() / int64(time.Millisecond)
+
+		if state.BreakerOpen {
+			log.Warningf("%s failed %d times in a row, waiting %s before trying again: %s", p.Name, p.BreakerThreshold, wait, err)
+		} else {
+			log.Warningf("%s failed (attempt %d). Retrying in %s: %s", p.Name, attempt, wait, err)
+		}
+
+		if notify != nil {
+			notify(state)
+		}
+
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var errTest = errors.New("Failed")
+
+func TestRetryIntervalGrowth(t *testing.T) {
+	p := &retryPolicy{Initial: time.Second, Max: time.Second * 10, Multiplier: 1.5}
+
+	expected := []time.Duration{time.Second, time.Millisecond * 1500, time.Millisecond * 2250, time.Millisecond * 3375}
+	for i, interval := range expected {
+		if got := p.interval(i + 1); got != interval {
+			t.Fatalf("Attempt %d: expected %s, got %s", i+1, interval, got)
+		}
+	}
+
+	if got := p.interval(20); got != p.Max {
+		t.Fatalf("Expected the interval to stop at %s, got %s", p.Max, got)
+	}
+}
+
+func TestRetryJitter(t *testing.T) {
+	p := &retryPolicy{Initial: time.Second, Max: time.Second, Multiplier: 2, Jitter: 0.5}
+
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		interval := p.interval(1)
+		if interval < time.Millisecond*500 || interval > time.Millisecond*1500 {
+			t.Fatalf("Jittered interval %s is out of range", interval)
+		}
+		seen[interval] = true
+	}
+
+	if len(seen) < 2 {
+		t.Fatal("Expected jitter to vary the interval")
+	}
+}
+
+func TestRetryUntilSuccess(t *testing.T) {
+	p := &retryPolicy{Name: "test", Initial: time.Millisecond, Max: time.Millisecond * 2, Multiplier: 2}
+
+	var states []retryState
+	calls := 0
+	err := p.run(func() error {
+		calls++
+		switch calls {
+		case 1, 2:
+			return errTest
+		case 3:
+			// Doesn't count as a failure
+			return errRetryNow
+		case 4:
+			return errTest
+		}
+		return nil
+	}, func(state retryState) {
+		states = append(states, state)
+	})
+
+	if err != nil || calls != 5 {
+		t.Fatalf("Expected success on the fifth call, got %v after %d", err, calls)
+	}
+
+	attempts := []int{}
+	for _, state := range states {
+		attempts = append(attempts, state.Attempt)
+	}
+	if len(attempts) != 3 || attempts[0] != 1 || attempts[1] != 2 || attempts[2] != 1 {
+		t.Fatalf("Expected errRetryNow to reset the attempts, got %v", attempts)
+	}
+}
+
+func TestRetryPermanentError(t *testing.T) {
+	p := &retryPolicy{Name: "test", Initial: time.Millisecond, Multiplier: 2}
+
+	calls := 0
+	err := p.run(func() error {
+		calls++
+		return permanent(errTest)
+	}, nil)
+
+	if err != errTest || calls != 1 {
+		t.Fatalf("Expected to stop at the permanent error, got %v after %d calls", err, calls)
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	p := &retryPolicy{Name: "test", Initial: time.Millisecond * 10, Max: time.Millisecond * 10, Multiplier: 1, Deadline: time.Millisecond * 35}
+
+	var last retryState
+	calls := 0
+	err := p.run(func() error {
+		calls++
+		return errTest
+	}, func(state retryState) {
+		last = state
+	})
+
+	if err == nil || !last.GaveUp {
+		t.Fatalf("Expected to give up, got %v %+v", err, last)
+	}
+	if calls < 3 || calls > 5 {
+		t.Fatalf("Expected about 4 attempts before the deadline, got %d", calls)
+	}
+}
+
+func TestRetryBreaker(t *testing.T) {
+	p := &retryPolicy{
+		Name:             "test",
+		Initial:          time.Millisecond,
+		Max:              time.Millisecond,
+		Multiplier:       1,
+		Jitter:           0.5,
+		BreakerThreshold: 3,
+		BreakerCooldown:  time.Millisecond * 100,
+	}
+
+	var states []retryState
+	calls := 0
+	started := time.Now()
+	p.run(func() error {
+		calls++
+		if calls > 4 {
+			return nil
+		}
+		return errTest
+	}, func(state retryState) {
+		states = append(states, state)
+	})
+
+	open := []bool{}
+	for _, state := range states {
+		open = append(open, state.BreakerOpen)
+	}
+
+	// Opens after the third failure, and again after the first one once half-open.
+	if len(open) != 4 || open[0] || open[1] || !open[2] || !open[3] {
+		t.Fatalf("Unexpected breaker states: %v", open)
+	}
+
+	if took := time.Since(started); took < time.Millisecond*100 {
+		t.Fatalf("Expected two cooldowns of at least 50ms each, took %s", took)
+	}
+
+	cooldowns := make(map[time.Duration]bool)
+	for i := 0; i < 20; i++ {
+		cooldowns[p.jitter(p.BreakerCooldown)] = true
+	}
+	if len(cooldowns) < 2 {
+		t.Fatal("Expected the cooldown to be jittered")
+	}
+}
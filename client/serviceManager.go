@@ -0,0 +1,294 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+const (
+	homeCloudService = "sphere-homecloud"
+	directorService  = "sphere-director"
+)
+
+// The init system used to control services. One of auto, upstart, systemd or fake. The fake one
+// (for dev machines) is never detected, so has to be asked for.
+var serviceManagerType = config.String("auto", "client", "services", "manager")
+
+// How long a service has to come up after being started.
+var serviceStartTimeout = config.Duration(time.Second*30, "client", "services", "startTimeout")
+
+// ServiceManager controls the system services the client depends on, such as HomeCloud and the
+// director.
+type ServiceManager interface {
+	Start(name string) error
+	Stop(name string) error
+	Restart(name string) error
+	Running(name string) (bool, error)
+}
+
+// NewServiceManager returns a ServiceManager for the configured init system, detecting it if
+// client.services.manager is "auto".
+func NewServiceManager() (ServiceManager, error) {
+
+	kind := serviceManagerType
+	if kind == "auto" {
+		var err error
+		if kind, err = detectInitSystem(); err != nil {
+			return nil, err
+		}
+		log.Infof("Detected init system: %s", kind)
+	}
+
+	switch kind {
+	case "upstart":
+		return &upstartServiceManager{}, nil
+	case "systemd":
+		return &systemdServiceManager{}, nil
+	case "fake":
+		return NewFakeServiceManager(), nil
+	}
+
+	return nil, fmt.Errorf("Unknown service manager: %s", kind)
+}
+
+// detectInitSystem works out which init system is running.
+func detectInitSystem() (string, error) {
+	if _, err := os.Stat("/run/systemd/system"); err == nil {
+		return "systemd", nil
+	}
+
+	if _, err := exec.LookPath("initctl"); err == nil {
+		return "upstart", nil
+	}
+
+	return "", errors.New("Failed to detect the init system. Set client.services.manager to upstart, systemd or fake.")
+}
+
+func runCommand(name string, args ...string) (string, error) {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return string(output), fmt.Errorf("Failed to run %s %s: %s - %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+type upstartServiceManager struct{}
+
+func (m *upstartServiceManager) Start(name string) error {
+	// Upstart fails to start jobs that are already running
+	if running, err := m.Running(name); err == nil && running {
+		return nil
+	}
+	_, err := runCommand("initctl", "start", name)
+	return err
+}
+
+func (m *upstartServiceManager) Stop(name string) error {
+	if running, err := m.Running(name); err == nil && !running {
+		return nil
+	}
+	_, err := runCommand("initctl", "stop", name)
+	return err
+}
+
+func (m *upstartServiceManager) Restart(name string) error {
+	if running, err := m.Running(name); err == nil && !running {
+		return m.Start(name)
+	}
+	_, err := runCommand("initctl", "restart", name)
+	return err
+}
+
+func (m *upstartServiceManager) Running(name string) (bool, error) {
+	output, err := runCommand("initctl", "status", name)
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(output, "start/running"), nil
+}
+
+type systemdServiceManager struct{}
+
+func (m *systemdServiceManager) Start(name string) error {
+	_, err := runCommand("systemctl", "start", name)
+	return err
+}
+
+func (m *systemdServiceManager) Stop(name string) error {
+	_, err := runCommand("systemctl", "stop", name)
+	return err
+}
+
+func (m *systemdServiceManager) Restart(name string) error {
+	_, err := runCommand("systemctl", "restart", name)
+	return err
+}
+
+func (m *systemdServiceManager) Running(name string) (bool, error) {
+	// is-active exits non-zero for anything but active, so only the output tells us about errors.
+	output, _ := exec.Command("systemctl", "is-active", name).Output()
+
+	switch strings.TrimSpace(string(output)) {
+	case "active", "reloading":
+		return true, nil
+	case "inactive", "failed", "activating", "deactivating":
+		return false, nil
+	}
+
+	return false, fmt.Errorf("Failed to get the status of %s: %s", name, strings.TrimSpace(string(output)))
+}
+
+var errNoServiceManager = errors.New("No service manager, so services aren't being controlled")
+
+// noopServiceManager is used if the init system can't be worked out, so the client still runs
+// (and meshes) without controlling any services. Everything fails with errNoServiceManager, so
+// services are never reported as running.
+type noopServiceManager struct{}
+
+func (m *noopServiceManager) Start(name string) error {
+	return errNoServiceManager
+}
+
+func (m *noopServiceManager) Stop(name string) error {
+	return errNoServiceManager
+}
+
+func (m *noopServiceManager) Restart(name string) error {
+	return errNoServiceManager
+}
+
+func (m *noopServiceManager) Running(name string) (bool, error) {
+	return false, errNoServiceManager
+}
+
+// FakeServiceManager just remembers which services are running. Used on dev machines.
+type FakeServiceManager struct {
+	sync.Mutex
+	running map[string]bool
+}
+
+func NewFakeServiceManager() *FakeServiceManager {
+	return &FakeServiceManager{running: make(map[string]bool)}
+}
+
+func (m *FakeServiceManager) Start(name string) error {
+	m.Lock()
+	defer m.Unlock()
+	log.Infof("Fake starting service %s", name)
+	m.running[name] = true
+	return nil
+}
+
+func (m *FakeServiceManager) Stop(name string) error {
+	m.Lock()
+	defer m.Unlock()
+	log.Infof("Fake stopping service %s", name)
+	m.running[name] = false
+	return nil
+}
+
+func (m *FakeServiceManager) Restart(name string) error {
+	return m.Start(name)
+}
+
+func (m *FakeServiceManager) Running(name string) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.running[name], nil
+}
+
+// serviceStatus is published on $node/<serial>/client/service when a service is started or
+// stopped.
+type serviceStatus struct {
+	Name    string `json:"name"`
+	Running bool   `json:"running"`
+	Error   string `json:"error,omitempty"`
+}
+
+// startService starts a service, then waits for it to come up, publishing whether it did.
+func (c *client) startService(name string) {
+	err := c.services.Start(name)
+
+	if err == nil {
+		err = waitForService(c.services, name, true, serviceStartTimeout)
+	}
+
+	c.publishServiceStatus(name, err)
+}
+
+// stopService stops a service, publishing whether it stopped.
+func (c *client) stopService(name string) {
+	err := c.services.Stop(name)
+
+	if err == nil {
+		err = waitForService(c.services, name, false, serviceStartTimeout)
+	}
+
+	c.publishServiceStatus(name, err)
+}
+
+func (c *client) publishServiceStatus(name string, err error) {
+	running, statusErr := c.services.Running(name)
+
+	status := serviceStatus{
+		Name:    name,
+		Running: running,
+	}
+
+	if err == nil {
+		err = statusErr
+	}
+
+	if err != nil {
+		log.Warningf("Service %s: %s", name, err)
+		status.Error = err.Error()
+	} else {
+		log.Infof("Service %s running: %t", name, running)
+	}
+
+	c.conn.PublishRaw(fmt.Sprintf("$node/%s/client/service", config.Serial()), status)
+}
+
+// waitForService waits until the service is (or isn't) running.
+func waitForService(services ServiceManager, name string, running bool, timeout time.Duration) error {
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		isRunning, err := services.Running(name)
+		if err == nil && isRunning == running {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("Timed out after %s waiting for %s (running: %t)", timeout, name, isRunning)
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// serviceStates returns whether each of the services the client controls is running.
+func (c *client) serviceStates() map[string]bool {
+	states := make(map[string]bool)
+
+	for _, name := range []string{homeCloudService, directorService} {
+		running, err := c.services.Running(name)
+		if err != nil {
+			log.Debugf("Failed to get the status of %s: %s", name, err)
+		}
+		states[name] = running
+	}
+
+	return states
+}
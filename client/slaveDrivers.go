@@ -0,0 +1,209 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+// If set, slaves keep running the director so drivers for their own peripherals work. Their
+// $device/# and $thing/# traffic crosses the bridge like everything else, attributed to the slave
+// by the mesh envelope's source.
+// Should be set on every node in the mesh, as the master has to claim its devices too.
+var slaveDriversEnabled = config.Bool(false, "client", "slaveDrivers", "enabled")
+
+// How often each node publishes the devices it exposes, and how long until a claim is stale.
+var deviceClaimInterval = config.Duration(time.Second*30, "client", "slaveDrivers", "claimInterval")
+var deviceClaimTimeout = config.Duration(time.Second*90, "client", "slaveDrivers", "claimTimeout")
+
+// deviceClaim is published on $node/<serial>/client/devices, listing the hardware (by natural id
+// type and id) exposed by the drivers on a node.
+type deviceClaim struct {
+	NodeID  string    `json:"nodeId"`
+	Master  bool      `json:"master"`
+	Devices []string  `json:"devices"`
+	Seen    time.Time `json:"-"`
+}
+
+// deviceConflict is published on $node/<serial>/client/devices/conflict when we stop bridging a
+// device because another node owns it.
+type deviceConflict struct {
+	Device string `json:"device"`
+	Owner  string `json:"owner"`
+}
+
+// deviceAnnouncement is the part of a $device/<id>/event/announce payload we need.
+type deviceAnnouncement struct {
+	NaturalID     string `json:"naturalId"`
+	NaturalIDType string `json:"naturalIdType"`
+	// Set (to meshSourceField) on announcements that crossed a bridge.
+	MeshSource string `json:"$mesh-source"`
+}
+
+// deviceOwnership makes sure each piece of hardware is only exposed to the site by one node, when
+// drivers on several nodes can see it (e.g. a LAN device). If two nodes expose the same one, the
+// master keeps it. Otherwise the node with the lowest id does. A slave that loses a device stops
+// bridging it, rather than stopping its driver, as the driver may also own hardware attached to
+// that slave alone.
+type deviceOwnership struct {
+	sync.Mutex
+	// local maps the ids of the devices exposed here to their hardware.
+	local  map[string]string
+	claims map[string]*deviceClaim
+	// lost maps the ids of our devices that another node owns to that node.
+	lost map[string]string
+}
+
+// beats returns whether this claim wins ownership of a device over the other.
+func (claim *deviceClaim) beats(other *deviceClaim) bool {
+	if claim.Master != other.Master {
+		return claim.Master
+	}
+	return claim.NodeID < other.NodeID
+}
+
+// startDeviceOwnership tracks the devices exposed here and on other nodes, to resolve which node
+// owns each.
+func (c *client) startDeviceOwnership() {
+
+	ownership := &deviceOwnership{
+		local:  make(map[string]string),
+		claims: make(map[string]*deviceClaim),
+		lost:   make(map[string]string),
+	}
+
+	c.mu.Lock()
+	c.devices = ownership
+	c.mu.Unlock()
+
+	c.conn.SubscribeRaw("$device/:device/event/announce", func(announcement *deviceAnnouncement, values map[string]string) bool {
+		if announcement.MeshSource != "" && announcement.MeshSource != config.Serial() {
+			return true
+		}
+
+		if announcement.NaturalIDType == "" || announcement.NaturalID == "" {
+			return true
+		}
+
+		ownership.Lock()
+		ownership.local[values["device"]] = announcement.NaturalIDType + ":" + announcement.NaturalID
+		ownership.Unlock()
+		return true
+	})
+
+	c.conn.SubscribeRaw("$node/:node/client/devices", func(claim *deviceClaim, values map[string]string) bool {
+		if claim.NodeID == config.Serial() || claim.NodeID != values["node"] {
+			return true
+		}
+
+		claim.Seen = time.Now()
+
+		ownership.Lock()
+		ownership.claims[claim.NodeID] = claim
+		ownership.Unlock()
+		return true
+	})
+
+	go func() {
+		for {
+			c.publishDeviceClaim(ownership)
+			c.resolveDeviceConflicts(ownership)
+			time.Sleep(deviceClaimInterval)
+		}
+	}()
+}
+
+func (c *client) publishDeviceClaim(ownership *deviceOwnership) {
+	ownership.Lock()
+	devices := []string{}
+	for _, hardware := range ownership.local {
+		devices = append(devices, hardware)
+	}
+	ownership.Unlock()
+
+	sort.Strings(devices)
+
+	c.conn.PublishRaw(fmt.Sprintf("$node/%s/client/devices", config.Serial()), &deviceClaim{
+		NodeID:  config.Serial(),
+		Master:  c.state.is(stateMaster),
+		Devices: devices,
+	})
+}
+
+// resolveDeviceConflicts stops bridging any of our devices that another node owns.
+func (c *client) resolveDeviceConflicts(ownership *deviceOwnership) {
+
+	lost := ownership.resolve(&deviceClaim{
+		NodeID: config.Serial(),
+		Master: c.state.is(stateMaster),
+	})
+
+	for _, conflict := range lost {
+		log.Infof("Device %s is also exposed by node %s, which owns it. No longer bridging ours.", conflict.Device, conflict.Owner)
+
+		c.conn.PublishRaw(fmt.Sprintf("$node/%s/client/devices/conflict", config.Serial()), conflict)
+	}
+}
+
+// resolve works out which of our devices a fresh claim from another node beats, returning those
+// newly lost. Devices are given back once that claim goes stale.
+func (ownership *deviceOwnership) resolve(mine *deviceClaim) []*deviceConflict {
+
+	ownership.Lock()
+	defer ownership.Unlock()
+
+	owners := make(map[string]*deviceClaim)
+
+	for id, claim := range ownership.claims {
+		if time.Since(claim.Seen) > deviceClaimTimeout {
+			delete(ownership.claims, id)
+			continue
+		}
+
+		if !claim.beats(mine) {
+			continue
+		}
+
+		for _, hardware := range claim.Devices {
+			if owner, ok := owners[hardware]; !ok || claim.beats(owner) {
+				owners[hardware] = claim
+			}
+		}
+	}
+
+	lost := make(map[string]string)
+	var newlyLost []*deviceConflict
+
+	for device, hardware := range ownership.local {
+		if owner, ok := owners[hardware]; ok {
+			lost[device] = owner.NodeID
+			if ownership.lost[device] != owner.NodeID {
+				newlyLost = append(newlyLost, &deviceConflict{Device: device, Owner: owner.NodeID})
+			}
+		}
+	}
+
+	ownership.lost = lost
+
+	return newlyLost
+}
+
+// owned returns whether messages on a topic should be bridged to the master, i.e. that it isn't
+// about one of our devices that another node owns.
+func (ownership *deviceOwnership) owned(topic string) bool {
+	if !strings.HasPrefix(topic, "$device/") {
+		return true
+	}
+
+	device := strings.SplitN(strings.TrimPrefix(topic, "$device/"), "/", 2)[0]
+
+	ownership.Lock()
+	defer ownership.Unlock()
+
+	_, lost := ownership.lost[device]
+	return !lost
+}
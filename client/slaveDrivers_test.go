@@ -0,0 +1,51 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeviceOwnership(t *testing.T) {
+	ownership := &deviceOwnership{
+		local: map[string]string{
+			"bulb-here":  "hue:bulb-1",
+			"zigbee-usb": "zigbee:stick-1",
+		},
+		claims: map[string]*deviceClaim{
+			"node-a": {NodeID: "node-a", Devices: []string{"hue:bulb-1"}, Seen: time.Now()},
+			"node-z": {NodeID: "node-z", Devices: []string{"zigbee:stick-1"}, Seen: time.Now()},
+		},
+		lost: make(map[string]string),
+	}
+
+	lost := ownership.resolve(&deviceClaim{NodeID: "node-m"})
+
+	if len(lost) != 1 || lost[0].Device != "bulb-here" || lost[0].Owner != "node-a" {
+		t.Fatalf("Expected only the shared bulb to be lost to node-a, got %v", lost)
+	}
+
+	if ownership.owned("$device/bulb-here/channel/light") {
+		t.Fatal("A lost device is still bridged")
+	}
+	if !ownership.owned("$device/zigbee-usb/channel/on-off") || !ownership.owned("$node/node-m/client/devices") {
+		t.Fatal("Devices we own (and other topics) must still be bridged")
+	}
+
+	if lost := ownership.resolve(&deviceClaim{NodeID: "node-m"}); len(lost) != 0 {
+		t.Fatalf("Expected a conflict to only be reported once, got %v", lost)
+	}
+
+	// The owner goes away, so we get it back.
+	ownership.claims["node-a"].Seen = time.Now().Add(-deviceClaimTimeout * 2)
+	ownership.resolve(&deviceClaim{NodeID: "node-m"})
+
+	if !ownership.owned("$device/bulb-here/channel/light") {
+		t.Fatal("Device wasn't given back when its owner went away")
+	}
+
+	// The master keeps everything.
+	ownership.claims["node-a"] = &deviceClaim{NodeID: "node-a", Devices: []string{"hue:bulb-1"}, Seen: time.Now()}
+	if lost := ownership.resolve(&deviceClaim{NodeID: "node-m", Master: true}); len(lost) != 0 {
+		t.Fatalf("The master lost %v", lost)
+	}
+}
@@ -0,0 +1,152 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+)
+
+type clientState string
+
+const (
+	stateUnpaired       clientState = "unpaired"
+	statePairing        clientState = "pairing"
+	statePaired         clientState = "paired"
+	stateMaster         clientState = "master"
+	stateSlaveSearching clientState = "slave-searching"
+	stateSlaveBridged   clientState = "slave-bridged"
+	stateOrphaned       clientState = "orphaned"
+)
+
+// stateTransitions lists the states that can be moved to from each state. When the master
+// changes, the client steps down to paired before taking up its new role.
+var stateTransitions = map[clientState][]clientState{
+	stateUnpaired:       {statePairing},
+	statePairing:        {statePaired, stateUnpaired},
+	statePaired:         {stateMaster, stateSlaveSearching, stateUnpaired},
+	stateMaster:         {statePaired, stateUnpaired},
+	stateSlaveSearching: {stateSlaveBridged, stateOrphaned, statePaired, stateUnpaired},
+	stateSlaveBridged:   {stateOrphaned, stateSlaveSearching, statePaired, stateUnpaired},
+	stateOrphaned:       {stateSlaveBridged, stateSlaveSearching, statePaired, stateUnpaired},
+}
+
+// stateMachine tracks the lifecycle of the client. Hooks are called (in the order they were added)
+// after each transition, on the state machine's own goroutine, so a transition never waits for the
+// hooks of an earlier one (which may be starting or stopping services). Hooks run one transition
+// at a time, in the order the transitions happened, and may transition the state themselves.
+type stateMachine struct {
+	sync.Mutex
+	state   clientState
+	hooks   []func(from, to clientState)
+	pending []stateChange
+	running bool
+	wake    chan struct{}
+	idle    *sync.Cond
+}
+
+type stateChange struct {
+	from, to clientState
+}
+
+func newStateMachine(initial clientState) *stateMachine {
+	m := &stateMachine{
+		state: initial,
+		wake:  make(chan struct{}, 1),
+	}
+	m.idle = sync.NewCond(m)
+	go m.run()
+	return m
+}
+
+func (m *stateMachine) current() clientState {
+	m.Lock()
+	defer m.Unlock()
+	return m.state
+}
+
+func (m *stateMachine) is(states ...clientState) bool {
+	current := m.current()
+	for _, s := range states {
+		if s == current {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *stateMachine) onTransition(hook func(from, to clientState)) {
+	m.Lock()
+	defer m.Unlock()
+	m.hooks = append(m.hooks, hook)
+}
+
+// transition moves to the given state, if allowed from the current one. Moving to the current
+// state does nothing. The hooks are run later.
+func (m *stateMachine) transition(to clientState) error {
+	m.Lock()
+	defer m.Unlock()
+
+	from := m.state
+
+	if from == to {
+		return nil
+	}
+
+	allowed := false
+	for _, s := range stateTransitions[from] {
+		if s == to {
+			allowed = true
+			break
+		}
+	}
+
+	if !allowed {
+		return fmt.Errorf("Invalid state transition from %s to %s", from, to)
+	}
+
+	m.state = to
+	m.pending = append(m.pending, stateChange{from, to})
+
+	log.Infof("Client state changed from %s to %s", from, to)
+
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// run calls the hooks for each transition in turn.
+func (m *stateMachine) run() {
+	for range m.wake {
+		for {
+			m.Lock()
+			if len(m.pending) == 0 {
+				m.running = false
+				m.idle.Broadcast()
+				m.Unlock()
+				break
+			}
+
+			change := m.pending[0]
+			m.pending = m.pending[1:]
+			m.running = true
+			hooks := append([]func(from, to clientState){}, m.hooks...)
+			m.Unlock()
+
+			for _, hook := range hooks {
+				hook(change.from, change.to)
+			}
+		}
+	}
+}
+
+// wait blocks until the hooks for every transition so far have run. Must not be called from a hook.
+func (m *stateMachine) wait() {
+	m.Lock()
+	defer m.Unlock()
+
+	for m.running || len(m.pending) > 0 {
+		m.idle.Wait()
+	}
+}
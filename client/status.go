@@ -0,0 +1,259 @@
+package client
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+// The address the status api listens on. Either a loopback host:port, or unix:<path> for a unix
+// socket. Set it to "" to disable the api.
+var statusAddress = config.String("127.0.0.1:8101", "client", "status", "address")
+
+// POSTs to the status api must carry the token written to this file, in the X-Client-Token header.
+var statusTokenFile = config.String("/var/run/ninja/client-status.token", "client", "status", "tokenFile")
+
+const statusTokenHeader = "X-Client-Token"
+
+type clientStatus struct {
+	NodeID         string            `json:"nodeId"`
+	State          string            `json:"state"`
+	Paired         bool              `json:"paired"`
+	NoCloud        bool              `json:"noCloud"`
+	Master         bool              `json:"master"`
+	MasterNodeID   string            `json:"masterNodeId"`
+	Bridged        bool              `json:"bridged"`
+	Orphaned       bool              `json:"orphaned"`
+	LastMasterSeen *time.Time        `json:"lastMasterSeen"`
+	Bridge         *meshBridgeHealth `json:"bridge"`
+	Services       map[string]bool   `json:"services"`
+	Readiness      *readinessStatus  `json:"readiness"`
+}
+
+func (c *client) status() *clientStatus {
+	bridge := c.bridgeHealth()
+	services := c.serviceStates()
+
+	status := &clientStatus{
+		NodeID:       config.Serial(),
+		State:        string(c.state.current()),
+		Paired:       isPaired(),
+		NoCloud:      config.NoCloud(),
+		Master:       c.state.is(stateMaster),
+		MasterNodeID: config.String("", "masterNodeId"),
+		Bridged:      c.state.is(stateSlaveBridged),
+		Orphaned:     c.state.is(stateOrphaned),
+		Bridge:       bridge,
+		Services:     services,
+		Readiness:    c.readiness.getStatus(),
+	}
+
+	if seen := c.peers.lastSeen(status.MasterNodeID); !seen.IsZero() {
+		status.LastMasterSeen = &seen
+	}
+
+	return status
+}
+
+// startStatusServer serves the client's state as JSON, and accepts a few actions, for local
+// debugging and tooling. It is only ever bound to localhost or a unix socket, and actions need the
+// token from the token file.
+func (c *client) startStatusServer() {
+	if statusAddress == "" {
+		return
+	}
+
+	var listener net.Listener
+	var err error
+
+	if strings.HasPrefix(statusAddress, "unix:") {
+		path := strings.TrimPrefix(statusAddress, "unix:")
+		os.Remove(path)
+		listener, err = net.Listen("unix", path)
+	} else if err = checkLoopback(statusAddress); err == nil {
+		listener, err = net.Listen("tcp", statusAddress)
+	}
+
+	if err != nil {
+		log.Warningf("Failed to start status api on %s: %s", statusAddress, err)
+		return
+	}
+
+	token, err := writeStatusToken()
+	if err != nil {
+		log.Warningf("Failed to start status api: %s", err)
+		listener.Close()
+		return
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, c.status())
+	})
+
+	mux.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, c.peers.list())
+	})
+
+	mux.HandleFunc("/mesh", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, &meshInfo{
+			SiteID:       config.String("", "siteId"),
+			MasterNodeID: config.String("", "masterNodeId"),
+			SiteUpdated:  config.Int(0, "siteUpdated"),
+			NoMesh:       config.Bool(false, "noMesh"),
+		})
+	})
+
+	mux.HandleFunc("/credentials/present", func(w http.ResponseWriter, r *http.Request) {
+		_, err := loadCreds()
+		writeJSON(w, map[string]bool{"present": err == nil})
+	})
+
+	mux.HandleFunc("/actions/rediscover", action(token, func() {
+		c.findPeers()
+	}))
+
+	mux.HandleFunc("/actions/rebridge", action(token, c.rebridge))
+
+	mux.HandleFunc("/actions/repair", action(token, func() {
+		if err := c.pair(); err != nil {
+			log.Warningf("Failed to re-pair: %s", err)
+			return
+		}
+		log.Infof("Re-paired. Restarting client to pick up the new credentials.")
+		os.Exit(0)
+	}))
+
+	// Lets local tooling on the master send signed commands to other nodes' devices, e.g.
+	// POST /actions/node?nodeId=<serial>&method=identify
+	mux.HandleFunc("/actions/node", func(w http.ResponseWriter, r *http.Request) {
+		if !authorizePost(token, w, r) {
+			return
+		}
+
+		var reply json.RawMessage
+		if err := c.callNode(r.FormValue("nodeId"), r.FormValue("method"), &reply); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		writeJSON(w, reply)
+	})
+
+	// Lets HomeCloud approve a node's request to join our site, once the user has entered the code
+	// shown on that node in the app, e.g. POST /actions/join?nodeId=<serial>&code=<code>
+	// It is denied with approved=false.
+	mux.HandleFunc("/actions/join", func(w http.ResponseWriter, r *http.Request) {
+		if !authorizePost(token, w, r) {
+			return
+		}
+
+		approved := r.FormValue("approved") != "false"
+
+		switch err := c.approveJoin(r.FormValue("nodeId"), r.FormValue("code"), approved); err {
+		case nil:
+			w.WriteHeader(http.StatusAccepted)
+		case errNoPendingJoin:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errJoinDenied:
+			http.Error(w, "Too many wrong codes, so the join request was denied", http.StatusForbidden)
+		default:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		}
+	})
+
+	log.Infof("Status api listening on %s", statusAddress)
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Warningf("Status api stopped: %s", err)
+		}
+	}()
+}
+
+// checkLoopback returns an error unless address is host:port on a loopback interface.
+func checkLoopback(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if host == "localhost" {
+		return nil
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("Refusing to listen on %s, which isn't a loopback address", address)
+	}
+
+	return nil
+}
+
+// writeStatusToken generates the token needed for POSTs, and writes it where local tooling can
+// read it.
+func writeStatusToken() (string, error) {
+	token, err := randomID()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(statusTokenFile), 0755); err != nil {
+		return "", fmt.Errorf("Failed to create %s: %s", filepath.Dir(statusTokenFile), err)
+	}
+
+	if err := writeFileAtomic(statusTokenFile, []byte(token), 0600); err != nil {
+		return "", fmt.Errorf("Failed to write status api token: %s", err)
+	}
+
+	return token, nil
+}
+
+// authorizePost checks a request is a POST with the token, and didn't come from a web page (which
+// browsers mark with an Origin header).
+func authorizePost(token string, w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+
+	if r.Header.Get("Origin") != "" {
+		http.Error(w, "Cross-origin requests are not allowed", http.StatusForbidden)
+		return false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(statusTokenHeader)), []byte(token)) != 1 {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// action wraps a function to be run in the background when POSTed to.
+func action(token string, fn func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizePost(token, w, r) {
+			return
+		}
+
+		go fn()
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warningf("Failed to write status api response: %s", err)
+	}
+}
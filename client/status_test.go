@@ -0,0 +1,59 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckLoopback(t *testing.T) {
+	for address, ok := range map[string]bool{
+		"127.0.0.1:8101": true,
+		"[::1]:8101":     true,
+		"localhost:8101": true,
+		":8101":          false,
+		"0.0.0.0:8101":   false,
+		"10.0.0.2:8101":  false,
+	} {
+		if err := checkLoopback(address); (err == nil) != ok {
+			t.Errorf("%s: expected ok:%t, got %v", address, ok, err)
+		}
+	}
+}
+
+func TestActionsNeedToken(t *testing.T) {
+	ran := make(chan bool, 1)
+	handler := action("secret", func() { ran <- true })
+
+	for _, test := range []struct {
+		method string
+		token  string
+		origin string
+		status int
+	}{
+		{"GET", "secret", "", http.StatusMethodNotAllowed},
+		{"POST", "", "", http.StatusUnauthorized},
+		{"POST", "wrong", "", http.StatusUnauthorized},
+		{"POST", "secret", "http://evil.example", http.StatusForbidden},
+		{"POST", "secret", "", http.StatusAccepted},
+	} {
+		r := httptest.NewRequest(test.method, "/actions/rebridge", nil)
+		if test.token != "" {
+			r.Header.Set(statusTokenHeader, test.token)
+		}
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%+v: expected %d, got %d", test, test.status, w.Code)
+		}
+	}
+
+	if !<-ran {
+		t.Fatal("Expected the action to run")
+	}
+}